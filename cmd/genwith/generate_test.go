@@ -0,0 +1,1495 @@
+//go:build integration
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var declaration = regexp.MustCompile(`(?m)^//\ttype (\w+) struct \{\n((?://\t\t.*\n)*)//\t\}`)
+
+// stub is the withServices the package provides when genwith does not generate it
+const stub = "func %s() %sOption {\n\treturn func(*%s) error { return nil }\n}"
+
+// declare writes the declarations the package provides for the generated file, the
+// Client is declared with the fields listed in the generated file
+func declare(t *testing.T, file string, args []string) {
+	t.Helper()
+	src, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := declaration.FindSubmatch(src)
+	if m == nil {
+		t.Fatal("no Client declaration in the generated file")
+	}
+	client, fields := string(m[1]), strings.ReplaceAll(string(m[2]), "//\t\t", "\t")
+
+	name, _ := value(args, "name")
+	_, ok := value(args, "client")
+	var decls []string
+	decls = append(decls, fmt.Sprintf("type %s struct {\n%s}", client, fields))
+	if !ok {
+		decls = append(decls, fmt.Sprintf("type %sOption func(*%s) error", name, client))
+	} else if _, ok = value(args, "services"); !ok {
+		decls = append(decls, fmt.Sprintf(stub, hooks(name)["withServices"], name, client))
+	}
+	// the declarations shared by the clients of the package
+	var shared []string
+	if _, ok = value(args, "gen-fault"); !ok {
+		fault, ok := value(args, "fault-type")
+		if !ok {
+			fault = "Fault"
+		}
+		shared = append(shared, fmt.Sprintf("type %s struct{ Code int; Message string }", fault),
+			fmt.Sprintf("func (f *%s) Error() string { return f.Message }", fault))
+	}
+	// the endpoint is generated from the oauth2 urls of --endpoints
+	generated := false
+	for _, arg := range args {
+		generated = generated || strings.HasPrefix(arg, "authURL=") || strings.HasPrefix(arg, "tokenURL=")
+	}
+	if !generated {
+		if _, ok = value(args, "endpoint"); ok {
+			shared = append(shared, "var Endpoint = oauth2.Endpoint{}")
+		}
+		if _, ok = value(args, "endpoint-func"); ok {
+			shared = append(shared, "func Endpoint() oauth2.Endpoint { return oauth2.Endpoint{} }")
+		}
+	}
+	if _, ok = value(args, "soft-errors"); ok {
+		shared = append(shared, "func softError(v interface{}) error { return nil }")
+	}
+
+	pkg, _ := value(args, "package")
+	dir, base := filepath.Dir(file), strings.TrimSuffix(filepath.Base(file), "_with.go")
+	source(t, filepath.Join(dir, base+"_client.go"), pkg, decls)
+	// each client of the package writes the same declarations
+	source(t, filepath.Join(dir, "provided.go"), pkg, shared)
+}
+
+// source writes the declarations to the file with the imports they use
+func source(t *testing.T, file, pkg string, decls []string) {
+	t.Helper()
+	body := strings.Join(decls, "\n\n")
+	var imports []string
+	for pkg, path := range map[string]string{
+		"http.":   "net/http",
+		"url.":    "net/url",
+		"io.":     "io",
+		"sync.":   "sync",
+		"time.":   "time",
+		"oauth2.": "golang.org/x/oauth2",
+	} {
+		if strings.Contains(body, pkg) {
+			imports = append(imports, fmt.Sprintf("%q", path))
+		}
+	}
+	src := fmt.Sprintf("package %s\n\nimport (\n%s\n)\n\n%s\n", pkg, strings.Join(imports, "\n"), body)
+	if err := os.WriteFile(file, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// module creates a module for the generated packages
+func module(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("goimports"); err != nil {
+		t.Skip("goimports is required to generate clients")
+	}
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/gw\n\ngo 1.21\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// genClient generates the client into the package in the directory and declares the
+// Client the generated code uses
+func genClient(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// the test helpers import the package by its import path
+	if err := os.WriteFile(filepath.Join(dir, "gw.go"), []byte("package gw\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	args = append([]string{"--package", "gw"}, args...)
+	if err := run(t, dir, args...); err != nil {
+		t.Fatalf("genwith %s: %v", strings.Join(args, " "), err)
+	}
+	prefix := "gw"
+	if name, _ := value(args, "name"); name != "" {
+		prefix += "_" + strings.ToLower(name)
+	}
+	declare(t, filepath.Join(dir, prefix+"_with.go"), args)
+}
+
+// genOpenAPI generates the client and the services of the spec into the package in the
+// directory, the Client embeds the services of the spec in place of the stub
+func genOpenAPI(t *testing.T, dir, spec string, args ...string) {
+	t.Helper()
+	args = append([]string{"--client", "--do", "--base-url", "https://example.com/api", "--encoder", "json"}, args...)
+	genClient(t, dir, args...)
+	name, _ := value(args, "name")
+	cmd := []string{"--package", "gw", "--name", name, "openapi", "--spec", spec}
+	if err := run(t, dir, cmd...); err != nil {
+		t.Fatalf("genwith %s: %v", strings.Join(cmd, " "), err)
+	}
+
+	prefix, services := "gw", "services"
+	if name != "" {
+		prefix, services = prefix+"_"+strings.ToLower(name), variant(name, services)
+	}
+	file := filepath.Join(dir, prefix+"_client.go")
+	src, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := hooks(name)["Client"]
+	decls := strings.Replace(string(src), fmt.Sprintf(stub, hooks(name)["withServices"], name, client), "", 1)
+	decls = strings.Replace(decls, "type "+client+" struct {\n", "type "+client+" struct {\n\t"+services+"\n", 1)
+	if err = os.WriteFile(file, []byte(decls), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gocmd runs the go command in the module, skipping the test if the modules of the
+// generated code cannot be downloaded
+func gocmd(t *testing.T, root string, args ...string) {
+	t.Helper()
+	tidy := exec.Command("go", "mod", "tidy")
+	tidy.Dir = root
+	if b, err := tidy.CombinedOutput(); err != nil {
+		t.Skipf("resolving the modules of the generated code: %s", b)
+	}
+	cmd := exec.Command("go", args...)
+	cmd.Dir = root
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("go %s: %v\n%s", strings.Join(args, " "), err, b)
+	}
+}
+
+// TestGenerate generates a package for each flag, with the flags it depends on, and for
+// combinations of flags into a module and vets the module
+func TestGenerate(t *testing.T) {
+	root := module(t)
+	include := filepath.Join(t.TempDir(), "include.tmpl")
+	if err := os.WriteFile(include, []byte("\n// {{.Vars.key}} is included\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	values["include"] = include
+	defer delete(values, "include")
+
+	tests := map[string][]string{
+		"oauth2": {"--client", "--do", "--token", "--config", "--endpoint", "--token-source",
+			"--concurrency-safe", "--refresh-hook", "--token-store", "--expiry-leeway", "--pkce",
+			"--device-flow", "--client-credentials", "--from-config", "--from-env", "--config-file"},
+		"transports": {"--client", "--do", "--ratelimit", "--ratelimit-adaptive", "--retry-after",
+			"--max-concurrency", "--retry", "--circuitbreaker", "--metrics", "--otel", "--logging",
+			"--expvar", "--brotli", "--compression", "--cache", "--response-cache", "--clock",
+			"--rollback", "--applied-options", "--wrap-errors"},
+		"errors": {"--client", "--do", "--http-error", "--capture-body", "--request-dump",
+			"--error-map", "404=ErrNotFound", "--gen-fault", "--soft-errors", "--health", "--ping",
+			"https://example.com/ping", "--shutdown", "--stats", "--curl", "--batch", "--queue"},
+		"requests": {"--client", "--do", "--base-url", "https://example.com/api", "--encoder", "json",
+			"--request-options", "--hooks", "--middleware", "--idempotency", "--request-ids",
+			"--useragent", "--timeout", "--proxy", "--tls", "--basicauth", "--bearer", "--sigv4",
+			"--jwt", "--providers", "--stream", "--sse", "--download", "--multipart", "--uploads",
+			"--websocket", "--builder", "--generics", "--do-response", "--no-content-error"},
+		"minimal": {"--minimal", "--client", "--do", "--bearer", "--retry", "--compression"},
+		"variant": {"--name", "Up", "--client", "--do", "--token", "--config", "--endpoint",
+			"--services", "activity", "--bench", "--test-helpers", "--retry", "--health", "--max-concurrency",
+			"--circuitbreaker"},
+		"oauth1": {"--client", "--do", "--oauth1"},
+		"endpoints": {"--client", "--config", "--endpoint-func", "--endpoints", "baseURL=https://example.com/api",
+			"--endpoints", "authURL=https://example.com/authorize", "--endpoints", "tokenURL=https://example.com/token"},
+	}
+	for _, decoder := range []string{"json", "xml", "msgpack", "ndjson", "custom", "auto"} {
+		tests["decoder-"+decoder] = []string{"--client", "--do", "--stream", "--decoder", decoder}
+	}
+	for _, encoder := range []string{"json", "xml", "form"} {
+		tests["encoder-"+encoder] = []string{"--client", "--do", "--encoder", encoder}
+	}
+	for _, flag := range newApp().Flags {
+		name := flag.Names()[0]
+		switch name {
+		case "help", "package":
+		default:
+			tests["flag-"+name] = args(name)
+		}
+	}
+	for name, args := range tests {
+		t.Run(name, func(t *testing.T) {
+			genClient(t, filepath.Join(root, name), args...)
+		})
+	}
+	// the default client and its variants share a package
+	t.Run("variants", func(t *testing.T) {
+		args := append(append([]string{}, tests["transports"]...), tests["requests"][2:]...)
+		for _, name := range []string{"", "Up", "Dn"} {
+			genClient(t, filepath.Join(root, "variants"), append([]string{"--name", name}, args...)...)
+		}
+	})
+	file := filepath.Join(t.TempDir(), "spec.yaml")
+	if err := os.WriteFile(file, []byte(spec), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("openapi", func(t *testing.T) {
+		genOpenAPI(t, filepath.Join(root, "openapi"), file)
+	})
+	t.Run("openapi-variant", func(t *testing.T) {
+		genOpenAPI(t, filepath.Join(root, "openapi-variant"), file, "--name", "Up")
+	})
+	if t.Failed() {
+		return
+	}
+	gocmd(t, root, "vet", "./...")
+}
+
+// TestBehavior generates a client for each test into a module and runs the test, in the
+// package of the client, against the generated code
+func TestBehavior(t *testing.T) {
+	root := module(t)
+	tests := map[string]struct {
+		args []string
+		test string
+	}{
+		"retry": {
+			args: []string{"--client", "--do", "--retry"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	var n int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("sent %d requests, expected 3", n)
+	}
+	// a post is not idempotent and is sent once
+	atomic.StoreInt32(&n, 0)
+	req, _ = http.NewRequest(http.MethodPost, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); err == nil {
+		t.Error("expected an error")
+	}
+	if n != 1 {
+		t.Errorf("sent %d requests, expected 1", n)
+	}
+}
+`,
+		},
+		"uploads": {
+			args: []string{"--client", "--do", "--uploads"},
+			test: `
+import (
+	"testing"
+)
+
+func TestUploadURL(t *testing.T) {
+	c, err := NewClient(WithUploadBaseURL("https://upload.example.com/api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := c.uploadURL("/files?name=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://upload.example.com/api/files?name=a" {
+		t.Errorf("upload url %s", u)
+	}
+	if _, err = NewClient(WithUploadBaseURL("file:///api")); err == nil {
+		t.Error("expected an error for a base url without a host")
+	}
+}
+`,
+		},
+		"precedence": {
+			args: []string{"--client", "--do", "--token", "--config", "--endpoint"},
+			test: `
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenAfterSource(t *testing.T) {
+	token := &oauth2.Token{AccessToken: "access"}
+	src := oauth2.StaticTokenSource(token)
+	if _, err := NewClient(WithTokenSource(src), WithHTTPTracing(false), WithToken(token)); err == nil {
+		t.Error("expected an error for a token following a token source")
+	}
+	if _, err := NewClient(WithAutoRefresh(context.Background()), WithToken(token)); err == nil {
+		t.Error("expected an error for a token following auto refresh")
+	}
+	// the http client replaces the transport authorizing with the source
+	if _, err := NewClient(WithTokenSource(src), WithHTTPClient(&http.Client{}), WithToken(token)); err != nil {
+		t.Error(err)
+	}
+}
+`,
+		},
+		"ping": {
+			args: []string{"--client", "--do", "--base-url", "https://example.com/api", "--ping", "/health"},
+			test: `
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/health":
+		case "/slow/health":
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithBaseURL(svr.URL + "/api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+	// the context bounds the ping
+	c, err = NewClient(WithBaseURL(svr.URL + "/slow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = c.Ping(ctx); err == nil {
+		t.Error("expected an error")
+	}
+}
+`,
+		},
+		"clock": {
+			args: []string{"--client", "--do", "--clock", "--ratelimit", "--retry"},
+			test: `
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	var n int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	// the clock advances an hour each time it is read
+	var mu sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Hour)
+		return now
+	}
+	c, err := NewClient(WithClock(clock), WithRateLimit(1.0/3600, 1), WithRetry(1, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hours of rate limiting and backoff pass on the clock
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, svr.URL, nil)
+		if err = c.do(req, &struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 4 {
+		t.Errorf("sent %d requests, expected 4", n)
+	}
+}
+`,
+		},
+		"refresh": {
+			args: []string{"--client", "--do", "--token", "--config", "--endpoint", "--refresh-hook", "--concurrency-safe"},
+			test: `
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRefresh(t *testing.T) {
+	var refreshes int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			atomic.AddInt32(&refreshes, 1)
+			time.Sleep(10 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{\"access_token\":\"new\",\"refresh_token\":\"next\",\"expires_in\":3600}"))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	c, err := NewClient(
+		WithConfig(oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: svr.URL + "/token"}}),
+		WithTokenCredentials("old", "refresh", time.Now().Add(-time.Hour)),
+		WithAutoRefresh(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the requests wait for a single refresh of the expired token
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+			if err := c.do(req, &struct{}{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, expected once", refreshes)
+	}
+}
+`,
+		},
+		"refresh-leeway": {
+			args: []string{"--client", "--do", "--token", "--config", "--endpoint", "--expiry-leeway", "--concurrency-safe"},
+			test: `
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRefreshLeeway(t *testing.T) {
+	var refreshes int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			atomic.AddInt32(&refreshes, 1)
+			time.Sleep(10 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{\"access_token\":\"new\",\"refresh_token\":\"next\",\"expires_in\":3600}"))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	c, err := NewClient(
+		WithConfig(oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: svr.URL + "/token"}}),
+		WithTokenCredentials("old", "refresh", time.Now().Add(-time.Hour)),
+		WithTokenExpiryLeeway(time.Minute),
+		WithAutoRefresh(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the requests wait for a single refresh of the expired token
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+			if err := c.do(req, &struct{}{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, expected once", refreshes)
+	}
+}
+`,
+		},
+		"breaker-health": {
+			args: []string{"--client", "--do", "--health", "--circuitbreaker"},
+			test: `
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerHealth(t *testing.T) {
+	var n int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		switch r.URL.Path {
+		case "/down":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithCircuitBreaker(2, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) error {
+		req, _ := http.NewRequest(http.MethodGet, svr.URL+path, nil)
+		return c.do(req, &struct{}{})
+	}
+	// client errors do not open the circuit
+	for i := 0; i < 3; i++ {
+		if err = get("/missing"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("missing: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err = get("/down"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("down: %v", err)
+		}
+	}
+	if err = get("/down"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected an open circuit, found %v", err)
+	}
+	if n != 5 {
+		t.Errorf("sent %d requests, expected 5", n)
+	}
+	// the circuit of each endpoint class opens independently
+	if err = get("/up"); err != nil {
+		t.Error(err)
+	}
+	// requests failing fast are not recorded
+	if h := c.Health()["GET /down"]; h.Requests != 2 || h.Errors != 2 {
+		t.Errorf("health %+v", h)
+	}
+}
+`,
+		},
+		"breaker": {
+			args: []string{"--client", "--do", "--clock", "--circuitbreaker"},
+			test: `
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var n int32
+	var down atomic.Value
+	down.Store(true)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		if down.Load().(bool) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	now := time.Now()
+	c, err := NewClient(WithClock(func() time.Time { return now }), WithCircuitBreaker(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() error {
+		req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+		return c.do(req, &struct{}{})
+	}
+	for i := 0; i < 2; i++ {
+		if err = get(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+	// the open circuit fails fast until the cooldown passes
+	if err = get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected an open circuit, found %v", err)
+	}
+	if n != 2 {
+		t.Errorf("sent %d requests, expected 2", n)
+	}
+	// a successful trial closes the circuit
+	now = now.Add(time.Minute)
+	down.Store(false)
+	for i := 0; i < 2; i++ {
+		if err = get(); err != nil {
+			t.Error(err)
+		}
+	}
+	if n != 4 {
+		t.Errorf("sent %d requests, expected 4", n)
+	}
+}
+`,
+		},
+		"cache": {
+			args: []string{"--client", "--do", "--cache"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConditionalCache(t *testing.T) {
+	var sent, validated int
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		if r.Header.Get("If-None-Match") == "\"v1\"" {
+			validated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", "\"v1\"")
+		w.Write([]byte("{\"name\":\"cached\"}"))
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithMemoryCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		var v struct{ Name string }
+		req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+		if err = c.do(req, &v); err != nil {
+			t.Fatal(err)
+		}
+		// the response is replayed from the cache when it is not modified
+		if v.Name != "cached" {
+			t.Errorf("request %d decoded %q", i, v.Name)
+		}
+	}
+	if sent != 2 || validated != 1 {
+		t.Errorf("sent %d requests, %d validated, expected 2 and 1", sent, validated)
+	}
+	// responses are cached for the credentials of the request
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	req.Header.Set("Authorization", "Bearer other")
+	if err = c.do(req, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if validated != 1 {
+		t.Error("the response cached without credentials was validated for other credentials")
+	}
+}
+`,
+		},
+		"cache-store": {
+			args: []string{"--client", "--do", "--cache"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// store is a Cache shared by clients
+type store struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func (s *store) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.m[key]
+	return b, ok
+}
+
+func (s *store) Set(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = value
+}
+
+func (s *store) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+}
+
+func TestConditionalCacheStore(t *testing.T) {
+	var validated int
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == "\"v1\"" {
+			validated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", "\"v1\"")
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	shared := &store{m: make(map[string][]byte)}
+	// a client revalidates the response another client cached in the store
+	for i := 0; i < 2; i++ {
+		c, err := NewClient(WithConditionalCache(shared))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+		if err = c.do(req, &struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(shared.m) != 1 || validated != 1 {
+		t.Errorf("stored %d responses, %d validated, expected 1 and 1", len(shared.m), validated)
+	}
+	if _, err := NewClient(WithConditionalCache(nil)); err == nil {
+		t.Error("expected an error for a nil cache")
+	}
+}
+`,
+		},
+		"response-cache": {
+			args: []string{"--client", "--do", "--clock", "--response-cache"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	var sent int
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte("{\"name\":\"cached\"}"))
+	}))
+	defer svr.Close()
+	store, err := NewMemoryCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c, err := NewClient(WithClock(func() time.Time { return now }), WithResponseCache(time.Minute, store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) string {
+		var v struct{ Name string }
+		req, _ := http.NewRequest(http.MethodGet, svr.URL+path, nil)
+		if err := c.do(req, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v.Name
+	}
+	// responses are replayed without a request until they expire
+	for i := 0; i < 2; i++ {
+		if name := get("/public"); name != "cached" {
+			t.Errorf("decoded %q", name)
+		}
+	}
+	if sent != 1 {
+		t.Errorf("sent %d requests, expected 1", sent)
+	}
+	now = now.Add(time.Minute)
+	get("/public")
+	if sent != 2 {
+		t.Errorf("sent %d requests, expected 2 once the response expired", sent)
+	}
+	// responses marked no-store are not cached
+	get("/private")
+	get("/private")
+	if sent != 4 {
+		t.Errorf("sent %d requests, expected 4", sent)
+	}
+}
+`,
+		},
+		"sse": {
+			args: []string{"--client", "--do", "--sse"},
+			test: `
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	var ids []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("Last-Event-ID"))
+		switch len(ids) {
+		case 1:
+			fmt.Fprint(w, "retry: 10\nid: 1\ndata: a\n\n")
+		case 2:
+			fmt.Fprint(w, ": comment\nid: 2\nevent: update\ndata: b\ndata: c\n\n")
+		default:
+			// the client stops reconnecting once the server responds with an error
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	c, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	events, err := c.Events(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []Event
+	for event := range events {
+		found = append(found, event)
+	}
+	if ctx.Err() != nil {
+		t.Fatal(ctx.Err())
+	}
+	expected := []Event{{ID: "1", Event: "message", Data: "a"}, {ID: "2", Event: "update", Data: "b\nc"}}
+	if fmt.Sprint(found) != fmt.Sprint(expected) {
+		t.Errorf("events %v, expected %v", found, expected)
+	}
+	// the reconnections resume after the last event
+	if fmt.Sprint(ids) != fmt.Sprint([]string{"", "1", "2"}) {
+		t.Errorf("last event ids %q", ids)
+	}
+}
+`,
+		},
+		"retry-after": {
+			args: []string{"--client", "--do", "--clock", "--ratelimit", "--retry-after"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRetryAfter(t *testing.T) {
+	var sent int
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		if sent%2 == 1 {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	// the clock advances a minute each time it is read
+	var mu sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Minute)
+		return now
+	}
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	c, err := NewClient(WithClock(clock), WithRateLimiter(limiter), WithRetryAfter(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Errorf("sent %d requests, expected 2", sent)
+	}
+	// without retries the response is returned
+	c, err = NewClient(WithClock(clock), WithRateLimiter(limiter), WithRetryAfter(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); err == nil {
+		t.Error("expected an error for too many requests")
+	}
+	if sent != 3 {
+		t.Errorf("sent %d requests, expected 3", sent)
+	}
+}
+`,
+		},
+		"max-concurrency": {
+			args: []string{"--client", "--do", "--max-concurrency"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrency(t *testing.T) {
+	var inflight, peak int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithMaxConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+			if err := c.do(req, &struct{}{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// the slot of a request is released once its response is closed
+	if peak != 2 {
+		t.Errorf("%d requests in flight, expected 2", peak)
+	}
+}
+`,
+		},
+		"leeway": {
+			args: []string{"--client", "--do", "--token", "--config", "--endpoint", "--expiry-leeway"},
+			test: `
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenExpiryLeeway(t *testing.T) {
+	var refreshes int
+	var authorization string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			refreshes++
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{\"access_token\":\"new\",\"expires_in\":3600}"))
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	tests := map[time.Duration]string{
+		// the token expires within the leeway and is refreshed
+		30 * time.Second: "Bearer new",
+		2 * time.Minute:  "Bearer old",
+	}
+	for expiry, expected := range tests {
+		refreshes = 0
+		c, err := NewClient(
+			WithConfig(oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: svr.URL + "/token"}}),
+			WithTokenCredentials("old", "refresh", time.Now().Add(expiry)),
+			WithTokenExpiryLeeway(time.Minute),
+			WithAutoRefresh(context.Background()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+			if err = c.do(req, &struct{}{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if authorization != expected || refreshes > 1 {
+			t.Errorf("expiring in %s: authorized with %q after %d refreshes", expiry, authorization, refreshes)
+		}
+	}
+}
+`,
+		},
+		"idempotency": {
+			args: []string{"--client", "--do", "--retry", "--idempotency"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	var keys []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithRetry(1, time.Millisecond), WithIdempotencyKeys("", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a post with a key is retried with the same key
+	req, _ := http.NewRequest(http.MethodPost, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("idempotency keys %q", keys)
+	}
+	// requests which are not mutating have no key
+	req, _ = http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if keys[2] != "" {
+		t.Errorf("get with the idempotency key %q", keys[2])
+	}
+}
+`,
+		},
+		"request-id": {
+			args: []string{"--client", "--do", "--request-ids"},
+			test: `
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var id string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = r.Header.Get("X-Trace-Id")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithRequestID("X-Trace-Id", func() string { return "trace" }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	err = c.do(req, &struct{}{})
+	var rerr *RequestIDError
+	if !errors.As(err, &rerr) || rerr.ID != "trace" || id != "trace" {
+		t.Errorf("error %v for the request %q", err, id)
+	}
+	// the id of the request is kept
+	req, _ = http.NewRequest(http.MethodGet, svr.URL, nil)
+	req.Header.Set("X-Trace-Id", "mine")
+	if err = c.do(req, &struct{}{}); !errors.As(err, &rerr) || rerr.ID != "mine" || id != "mine" {
+		t.Errorf("error %v for the request %q", err, id)
+	}
+}
+`,
+		},
+		"compression": {
+			args: []string{"--client", "--do", "--compression"},
+			test: `
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte("{\"name\":\"identity\"}"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("{\"name\":\"gzip\"}"))
+		gz.Close()
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithCompression())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ Name string }
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "gzip" {
+		t.Errorf("decoded %q", v.Name)
+	}
+}
+`,
+		},
+		"decompression-limit": {
+			args: []string{"--client", "--do", "--compression"},
+			test: `
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaxDecompressedSize(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("\""))
+		gz.Write(bytes.Repeat([]byte("a"), 1<<20))
+		gz.Write([]byte("\""))
+		gz.Close()
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithCompression(), WithMaxDecompressedSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	var limit *DecompressionLimitError
+	if err = c.do(req, &s); !errors.As(err, &limit) || limit.Limit != 1<<10 {
+		t.Errorf("expected a decompression limit error, found %v", err)
+	}
+	if _, err = NewClient(WithMaxDecompressedSize(0)); err == nil {
+		t.Error("expected an error for a limit which is not positive")
+	}
+}
+`,
+		},
+		"adaptive": {
+			args: []string{"--client", "--do", "--ratelimit", "--ratelimit-adaptive"},
+			test: `
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestAdaptiveRateLimiter(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the lowest rate of the windows is used
+		w.Header().Set("X-RateLimit-Remaining", "50, 1")
+		w.Header().Set("X-RateLimit-Reset", "100, 60")
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	limiter := rate.NewLimiter(rate.Inf, 10)
+	c, err := NewClient(WithAdaptiveRateLimiter(limiter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if l := float64(limiter.Limit()); math.Abs(l-1.0/60) > 1e-9 || limiter.Burst() != 1 {
+		t.Errorf("limit %f and burst %d, expected %f and 1", l, limiter.Burst(), 1.0/60)
+	}
+}
+`,
+		},
+		"limiters": {
+			args: []string{"--client", "--do", "--ratelimit"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimiters(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+	// the limiter of the uploads permits no requests
+	c, err := NewClient(WithRateLimiters(map[string]*rate.Limiter{
+		u.Host:              rate.NewLimiter(rate.Inf, 1),
+		u.Host + "/uploads": rate.NewLimiter(0, 0),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"/uploads":        true,
+		"/uploads/a":      true,
+		"/uploadsandmore": false,
+		"/api":            false,
+	}
+	for path, limited := range tests {
+		req, _ := http.NewRequest(http.MethodGet, svr.URL+path, nil)
+		if err = c.do(req, &struct{}{}); (err != nil) != limited {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
+`,
+		},
+		"shutdown": {
+			args: []string{"--client", "--do", "--shutdown"},
+			test: `
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	c, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+		done <- c.do(req, &struct{}{})
+	}()
+	<-started
+	// the client waits for the request in flight to finish
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err = c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 25*time.Millisecond {
+		t.Errorf("shut down in %s with a request in flight", d)
+	}
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); !errors.Is(err, ErrShutdown) {
+		t.Errorf("expected ErrShutdown, found %v", err)
+	}
+}
+`,
+		},
+		"hooks": {
+			args: []string{"--client", "--do", "--hooks"},
+			test: `
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	var header string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Hooked")
+		w.Header().Set("X-Status", "degraded")
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	degraded := errors.New("degraded")
+	c, err := NewClient(
+		WithRequestHook(func(req *http.Request) error {
+			req.Header.Set("X-Hooked", "yes")
+			return nil
+		}),
+		WithResponseHook(func(res *http.Response) error {
+			if res.Header.Get("X-Status") == "degraded" {
+				return degraded
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); !errors.Is(err, degraded) {
+		t.Errorf("expected the error of the response hook, found %v", err)
+	}
+	if header != "yes" {
+		t.Error("the request hook did not modify the request")
+	}
+	// an error of a request hook aborts the request
+	header = ""
+	c, err = NewClient(WithRequestHook(func(*http.Request) error { return degraded }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); !errors.Is(err, degraded) || header != "" {
+		t.Errorf("expected the request to be aborted, found %v", err)
+	}
+}
+`,
+		},
+		"middleware": {
+			args: []string{"--client", "--do", "--middleware"},
+			test: `
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// roundTripper adapts a function to an http.RoundTripper
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// tag returns middleware appending the name to the X-Order header of requests
+func tag(name string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripper(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Add("X-Order", name)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = r.Header.Values("X-Order")
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+	c, err := NewClient(WithMiddleware(tag("b"), tag("c")), WithMiddleware(tag("a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, svr.URL, nil)
+	if err = c.do(req, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	// the middleware of later options and the first middleware of an option are outermost
+	if s := strings.Join(order, ","); s != "a,b,c" {
+		t.Errorf("middleware order %s, expected a,b,c", s)
+	}
+}
+`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(root, name)
+			genClient(t, dir, tt.args...)
+			src := []byte("package gw\n" + tt.test)
+			if err := os.WriteFile(filepath.Join(dir, "gw_behavior_test.go"), src, 0600); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	if t.Failed() {
+		return
+	}
+	gocmd(t, root, "test", "./...")
+}
@@ -5,8 +5,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"go/token"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -23,9 +29,149 @@ type with struct {
 	EndpointFunc bool
 	Client       bool
 	RateLimiter  bool
+	RequestDump  bool
+	HTTPError    bool
+	Health       bool
 	Flags        string
 	Package      string
 	Decoder      string
+	NDJSON       bool
+	Custom       bool
+	Auto         bool
+	Encoder      string
+	Generics     bool
+	Fluent       bool
+	Stream       bool
+	SSE          bool
+	WebSocket    bool
+	Multipart    bool
+	Download     bool
+	Compression  bool
+	TTLCache     bool
+	Idempotency  bool
+	RequestIDs   bool
+	RetryAfter   bool
+	Adaptive     bool
+	Concurrency  bool
+	Hooks        bool
+	Middleware   bool
+	RequestID    string
+	Fault        string
+	Ping         string
+	Name         string
+	Builder      bool
+	FromConfig   bool
+	FromEnv      bool
+	ConfigFile   bool
+	RequestOpts  bool
+	Services     []string
+	Endpoints    map[string]string
+	API          *api
+	Rollback     bool
+	Applied      bool
+	Safe         bool
+	TokenSource  bool
+	Clock        bool
+	SoftErrors   bool
+	Brotli       bool
+	Cache        bool
+	Queue        bool
+	Batch        bool
+	Expvar       bool
+	Bench        bool
+	Minimal      bool
+	Helpers      bool
+	ImportPath   string
+	Vars         map[string]string
+	WrapErrors   bool
+	Shutdown     bool
+	Stats        bool
+	Doc          bool
+	Providers    bool
+	Curl         bool
+	Uploads      bool
+	Retry        bool
+	Breaker      bool
+	Metrics      bool
+	Otel         bool
+	Logging      bool
+	UserAgent    bool
+	BaseURL      *url.URL
+	Timeout      bool
+	Proxy        bool
+	TLS          bool
+	BasicAuth    bool
+	Bearer       bool
+	HMAC         string
+	SigV4        bool
+	TwoLegged    bool
+	PKCE         bool
+	DeviceFlow   bool
+	OAuth1       bool
+	JWT          bool
+	RefreshHook  bool
+	TokenStore   bool
+	Leeway       bool
+	GenFault     bool
+	CaptureBody  bool
+	ErrorMap     []statusError
+	DoResponse   bool
+	NoContent    bool
+}
+
+// statusError is a sentinel error returned by do for responses with the status code
+type statusError struct {
+	Code    int
+	Name    string
+	Message string
+}
+
+// errorMap parses the code=name pairs of the sentinel errors ordered by code
+func errorMap(pairs []string) ([]statusError, error) {
+	var errs []statusError
+	for _, pair := range pairs {
+		code, name, ok := strings.Cut(pair, "=")
+		if !ok || !token.IsIdentifier(name) {
+			return nil, fmt.Errorf("--error-map '%s' must be of the form code=identifier", pair)
+		}
+		n, err := strconv.Atoi(code)
+		if err != nil || http.StatusText(n) == "" {
+			return nil, fmt.Errorf("--error-map '%s' has an unknown status code", pair)
+		}
+		errs = append(errs, statusError{Code: n, Name: name, Message: strings.ToLower(http.StatusText(n))})
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Code < errs[j].Code })
+	return errs, nil
+}
+
+// Ident returns the identifier renamed for the client variant, if any
+func (w with) Ident(ident string) string {
+	if w.Name == "" {
+		return ident
+	}
+	return variant(w.Name, ident)
+}
+
+// Tag returns the struct tag of the field for the decoder of the generated code
+func (w with) Tag(field string) string {
+	if w.Auto {
+		return tag(field, w.Decoder, "xml")
+	}
+	return tag(field, w.Decoder)
+}
+
+// FileTag returns the struct tag of the field for the formats of the config file
+func (w with) FileTag(field string) string {
+	return tag(field, "json", "yaml")
+}
+
+// tag returns a raw string struct tag naming the field for each key
+func tag(field string, keys ...string) string {
+	tags := make([]string, len(keys))
+	for i, key := range keys {
+		tags[i] = fmt.Sprintf("%s:%q", key, field)
+	}
+	return "`" + strings.Join(tags, " ") + "`"
 }
 
 const (
@@ -34,24 +180,172 @@ const (
 package {{.Package}}
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"container/heap"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
+	"hash"
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/bzimmer/httpwares"
+	"github.com/coder/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/oauth2/jwt"
 	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
 	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+{{- with .Endpoints}}
+{{- if .baseURL}}
+
+// BaseURL is the url of the api
+const BaseURL = {{printf "%q" .baseURL}}
+{{- end}}
+{{- if or .authURL .tokenURL}}
+
+// the urls of the oauth2 endpoint
+const (
+	AuthURL  = {{printf "%q" (index . "authURL")}}
+	TokenURL = {{printf "%q" (index . "tokenURL")}}
+)
+{{- if $.EndpointFunc}}
+
+// Endpoint returns the oauth2 endpoint of the api
+func Endpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{AuthURL: AuthURL, TokenURL: TokenURL}
+}
+{{- else}}
+
+// Endpoint is the oauth2 endpoint of the api
+var Endpoint = oauth2.Endpoint{AuthURL: AuthURL, TokenURL: TokenURL}
+{{- end}}
+{{- end}}
+{{- end}}
+
+// The package declares the {{.Ident "Client"}} with the fields used by the generated code:
+//
+//	type {{.Ident "Client"}} struct {
+//		client *http.Client
+{{- if .Services}}
+//		{{.Ident "services"}}
+{{- end}}
+{{- if or .Token .Endpoint .EndpointFunc}}
+//		token *oauth2.Token
+{{- end}}
+{{- if .Config}}
+//		config oauth2.Config
+{{- end}}
+{{- if and .Safe .Token}}
+//		mu sync.RWMutex
+{{- end}}
+{{- if .Token}}
+//		source oauth2.TokenSource
+{{- end}}
+{{- if or .RefreshHook .TokenStore}}
+//		refreshHook func(*oauth2.Token) error
+{{- end}}
+{{- if .Leeway}}
+//		expiryLeeway time.Duration
+{{- end}}
+{{- if .Providers}}
+//		providers map[string]oauth2.TokenSource
+{{- end}}
+{{- if .BaseURL}}
+//		baseURL *url.URL
+{{- end}}
+{{- if .Uploads}}
+//		uploads *http.Client
+//		uploadBase *url.URL
+{{- end}}
+{{- if .Custom}}
+//		decoder {{.Ident "Decoder"}}
+{{- end}}
+{{- if or .Brotli .Compression}}
+//		maxDecompressedSize int64
+{{- end}}
+{{- if .Retry}}
+//		backoff {{.Ident "Backoff"}}
+{{- end}}
+{{- if .Hooks}}
+//		requestHooks []func(*http.Request) error
+//		responseHooks []func(*http.Response) error
+{{- end}}
+{{- if .Stats}}
+//		stats func({{.Ident "Stat"}})
+{{- end}}
+{{- if .Curl}}
+//		curl io.Writer
+{{- end}}
+{{- if .Health}}
+//		health *{{.Ident "health"}}
+{{- end}}
+{{- if .Shutdown}}
+//		inflight *{{.Ident "inflight"}}
+{{- end}}
+{{- if .Clock}}
+//		clock func() time.Time
+{{- end}}
+{{- if .Applied}}
+//		applied []string
+{{- end}}
+{{- if .Rollback}}
+//		teardown []func()
+{{- end}}
+//	}
+
 {{if .Client}}
 type service struct {
 	client *Client //nolint:golint,structcheck
 }
 
 // Option provides a configuration mechanism for a Client
+//
+// Options are applied in order and when two Options set the same value the last
+// one wins. WithTransport and WithHTTPClient replace the transport, including those
+// installed by earlier Options, so apply them first; the Options which authorize or
+// otherwise decorate requests wrap the transport configured before them. Options
+// which would set a value the client no longer uses, such as a token following an
+// Option authorizing requests with a token source, return an error.
 type Option func(*Client) error
 
 // NewClient creates a new client and applies all provided Options
@@ -61,6 +355,31 @@ func NewClient(opts ...Option) (*Client, error) {
 	{{- if .Token}}
 		token:  &oauth2.Token{},
 	{{- end}}
+	{{- if .Health}}
+		health: newHealth(),
+	{{- end}}
+	{{- if .Shutdown}}
+		inflight: &inflight{},
+	{{- end}}
+	{{- if .Uploads}}
+		uploads: &http.Client{},
+	{{- end}}
+	{{- if .BaseURL}}
+		baseURL: &url.URL{
+			Scheme: {{printf "%q" .BaseURL.Scheme}},
+			Host:   {{printf "%q" .BaseURL.Host}},
+			Path:   {{printf "%q" .BaseURL.Path}},
+		},
+	{{- end}}
+	{{- if .Clock}}
+		clock:  time.Now,
+	{{- end}}
+	{{- if or .Brotli .Compression}}
+		maxDecompressedSize: defaultMaxDecompressedSize,
+	{{- end}}
+	{{- if .Custom}}
+		decoder: DecoderFunc(decodeJSON),
+	{{- end}}
 	{{- if .Config}}
 		config: oauth2.Config{
 	{{- if .EndpointFunc}}
@@ -72,207 +391,5154 @@ func NewClient(opts ...Option) (*Client, error) {
 		},
 	{{- end}}
 	}
+	{{- if .Uploads}}
+	c.uploads.Transport = &apiTransport{c: c}
+	{{- end}}
 	opts = append(opts, withServices())
+	{{- if .Rollback}}
+	var states []transportState
+	{{- end}}
 	for _, opt := range opts {
+		{{- if .Rollback}}
+		states = append(states, transportState{client: c.client, transport: c.client.Transport})
+		{{- end}}
 		if err := opt(c); err != nil {
+			{{- if .Rollback}}
+			c.rollback(states)
+			{{- end}}
+			{{- if .WrapErrors}}
+			return nil, &OptionError{Option: optionName(opt), Err: err}
+			{{- else}}
 			return nil, err
+			{{- end}}
 		}
+		{{- if .Applied}}
+		c.applied = append(c.applied, optionName(opt))
+		{{- end}}
 	}
+	{{- if .Rollback}}
+	c.teardown = nil
+	{{- end}}
 	return c, nil
 }
-{{end}}
 
-{{if .Config}}
-// WithConfig sets the underlying oauth2.Config.
-func WithConfig(config oauth2.Config) Option {
+// now returns the current time from the client's clock
+func (c *Client) now() time.Time {
+	{{- if .Clock}}
+	return c.clock()
+	{{- else}}
+	return time.Now()
+	{{- end}}
+}
+{{- if .Services}}
+
+// services are the api services of the Client, embed it in the Client declaration
+type services struct {
+{{- range .Services}}
+	{{.}} *{{.}}Service
+{{- end}}
+}
+{{range .Services}}
+// {{.}}Service is the {{.}} api service
+type {{.}}Service struct {
+	service
+}
+{{end}}
+// withServices creates the services of the client
+func withServices() Option {
 	return func(c *Client) error {
-		c.config = config
+		{{- range .Services}}
+		c.{{.}} = &{{.}}Service{service{client: c}}
+		{{- end}}
 		return nil
 	}
 }
-// WithAPICredentials provides the client api credentials for the application.
-func WithClientCredentials(clientID, clientSecret string) Option {
-	return func(c *Client) error {
-		c.config.ClientID = clientID
-		c.config.ClientSecret = clientSecret
+{{- end}}
+{{end}}
+
+{{if or .Client .SSE}}
+// sleep returns after the duration has passed on the client's clock or when ctx is done
+func (c *Client) sleep(ctx context.Context, d time.Duration) error {
+	{{- if .Clock}}
+	until := c.now().Add(d)
+	for d > 0 {
+		// wake periodically to observe a clock advanced by tests
+		if d > clockTick {
+			d = clockTick
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		d = until.Sub(c.now())
+	}
+	return nil
+	{{- else}}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
 		return nil
 	}
+	{{- end}}
 }
+{{end}}
 
-{{if or .Endpoint .EndpointFunc}}
-// WithAutoRefresh refreshes access tokens automatically.
-// The order of this option matters because it is dependent on the client's
-// config and token. Use this option after With*Credentials.
-func WithAutoRefresh(ctx context.Context) Option {
+{{if .Clock}}
+// clockTick is the longest a wait sleeps before reading the clock again
+const clockTick = 10 * time.Millisecond
+
+// WithClock sets the clock used for generated time keeping, such as health tracking,
+// token expiry, rate limiting, and the waits between retries, so tests may control the
+// passage of time. Waits read the clock every clockTick and end once it has advanced.
+func WithClock(clock func() time.Time) Option {
 	return func(c *Client) error {
-		c.client = c.config.Client(ctx, c.token)
+		if clock == nil {
+			return errors.New("nil clock")
+		}
+		c.clock = clock
 		return nil
 	}
 }
 {{end}}
+
+{{if .Safe}}
+{{- if .Config}}
+// OAuth2Config returns a copy of the client's oauth2.Config.
+// The config is immutable once NewClient returns and safe to read concurrently.
+func (c *Client) OAuth2Config() oauth2.Config {
+	config := c.config
+	config.Scopes = append([]string(nil), c.config.Scopes...)
+	return config
+}
 {{end}}
+{{- if .Token}}
+// OAuth2Token returns a copy of the client's most recent oauth2.Token.
+// The token is guarded by the client's mutex since auto-refresh may replace it at any time.
+func (c *Client) OAuth2Token() *oauth2.Token {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	token := *c.token
+	return &token
+}
+{{if and .Config (or .Endpoint .EndpointFunc)}}
+// tokenTracker records tokens issued by the source on the client, in the order the
+// source issued them
+type tokenTracker struct {
+	c   *Client
+	mu  sync.Mutex
+	src oauth2.TokenSource
+}
 
-{{if .Token}}
-// WithToken sets the underlying oauth2.Token.
-func WithToken(token *oauth2.Token) Option {
-	return func(c *Client) error {
-		c.token = token
-		return nil
+func (t *tokenTracker) Token() (*oauth2.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	token, err := t.src.Token()
+	if err != nil {
+		return nil, err
 	}
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	t.c.token = token
+	return token, nil
 }
+{{end}}
+{{- end}}
+{{end}}
 
-// WithTokenCredentials provides the tokens for an authenticated user.
-func WithTokenCredentials(accessToken, refreshToken string, expiry time.Time) Option {
-	return func(c *Client) error {
-		c.token.AccessToken = accessToken
-		c.token.RefreshToken = refreshToken
-		c.token.Expiry = expiry
-		return nil
+{{if .TokenSource}}
+var _ oauth2.TokenSource = (*Client)(nil)
+
+// Token returns the client's current token, refreshing it first if auto-refresh
+// is enabled, so the client can be used as an oauth2.TokenSource
+func (c *Client) Token() (*oauth2.Token, error) {
+	if c.source != nil {
+		return c.source.Token()
 	}
+	{{- if .Safe}}
+	return c.OAuth2Token(), nil
+	{{- else}}
+	token := *c.token
+	return &token, nil
+	{{- end}}
 }
 {{end}}
 
-{{if .RateLimiter}}
-// WithRateLimiter rate limits the client's api calls
-func WithRateLimiter(r *rate.Limiter) Option {
-	return func(c *Client) error {
-		if r == nil {
-			return errors.New("nil limiter")
-		}
-		c.client.Transport = &httpwares.RateLimitTransport{
-			Limiter:   r,
-			Transport: c.client.Transport,
-		}
-		return nil
+{{if and .Client (or .Applied .WrapErrors)}}
+// optionName returns the name of the function which created the Option
+func optionName(opt Option) string {
+	name := runtime.FuncForPC(reflect.ValueOf(opt).Pointer()).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	if parts := strings.Split(name, "."); len(parts) > 1 {
+		return parts[1]
 	}
+	return name
 }
 {{end}}
 
-// WithHTTPTracing enables tracing http calls.
-func WithHTTPTracing(debug bool) Option {
+{{if and .Client .WrapErrors}}
+// OptionError is returned by NewClient when an Option fails
+type OptionError struct {
+	Option string
+	Err    error
+}
+
+func (e *OptionError) Error() string {
+	return "option " + e.Option + ": " + e.Err.Error()
+}
+
+func (e *OptionError) Unwrap() error {
+	return e.Err
+}
+{{end}}
+
+{{if .Applied}}
+// AppliedOptions returns the names of the Options applied by NewClient in order
+func (c *Client) AppliedOptions() []string {
+	return append([]string(nil), c.applied...)
+}
+{{end}}
+
+{{if .Rollback}}
+// transportState records a client's transport prior to applying an Option
+type transportState struct {
+	client    *http.Client
+	transport http.RoundTripper
+}
+
+// onTeardown registers fn to release resources acquired by an Option, such as registered
+// metrics or a created cache directory, if NewClient fails
+func (c *Client) onTeardown(fn func()) {
+	c.teardown = append(c.teardown, fn)
+}
+
+// rollback releases the resources acquired by applied Options and restores the
+// transports of any http clients they modified, both in reverse order
+func (c *Client) rollback(states []transportState) {
+	for i := len(c.teardown) - 1; i >= 0; i-- {
+		c.teardown[i]()
+	}
+	c.teardown = nil
+	for i := len(states) - 1; i >= 0; i-- {
+		states[i].client.Transport = states[i].transport
+	}
+}
+{{end}}
+
+{{if .Config}}
+// WithConfig sets the underlying oauth2.Config.
+func WithConfig(config oauth2.Config) Option {
 	return func(c *Client) error {
-		if !debug {
-			return nil
-		}
-		c.client.Transport = &httpwares.VerboseTransport{
-			Transport: c.client.Transport,
-		}
+		c.config = config
+		{{- if .Safe}}
+		c.config.Scopes = append([]string(nil), config.Scopes...)
+		{{- end}}
 		return nil
 	}
 }
-
-// WithTransport sets the underlying http client transport.
-func WithTransport(t http.RoundTripper) Option {
+// WithAPICredentials provides the client api credentials for the application.
+func WithClientCredentials(clientID, clientSecret string) Option {
 	return func(c *Client) error {
-		if t == nil {
-			return errors.New("nil transport")
-		}
-		c.client.Transport = t
+		c.config.ClientID = clientID
+		c.config.ClientSecret = clientSecret
 		return nil
 	}
 }
 
-// WithHTTPClient sets the underlying http client.
-func WithHTTPClient(client *http.Client) Option {
+// AuthCodeURL returns the url of the provider's consent page for the authorization code flow
+func (c *Client) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return c.config.AuthCodeURL(state, opts...)
+}
+
+// Exchange converts the authorization code into a token{{if .Token}}, the token is used by the
+// client for subsequent requests{{end}}
+func (c *Client) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	token, err := c.config.Exchange(ctx, code, opts...)
+	if err != nil {
+		return nil, err
+	}
+	{{- if .Token}}
+	{{- if .Safe}}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	{{- end}}
+	c.token = token
+	{{- end}}
+	return token, nil
+}
+
+{{if or .Endpoint .EndpointFunc}}
+// WithAutoRefresh refreshes access tokens automatically, the context is used for
+// token refresh requests and the transport configured before this option sends
+// the api requests. The order of this option matters because it is dependent on
+// the client's config and token. Use this option after With*Credentials.
+//
+// Concurrent requests share a single refresh of the token,
+{{- if .Leeway}} the source refreshing within the
+// expiry leeway holds a lock while refreshing
+{{- else}} the source of the config, an
+// oauth2.ReuseTokenSource, holds a lock while refreshing
+{{- end}}, so the refresh token is not sent twice.
+func WithAutoRefresh(ctx context.Context) Option {
 	return func(c *Client) error {
-		if client == nil {
-			return errors.New("nil client")
+		{{- if .Leeway}}
+		src := c.config.TokenSource(ctx, c.token)
+		if c.expiryLeeway > 0 {
+			src = &leewaySource{ctx: ctx, config: c.config, leeway: c.expiryLeeway, now: c.now, token: c.token}
 		}
-		c.client = client
+		src = &reauthSource{src: src}
+		{{- else}}
+		var src oauth2.TokenSource = &reauthSource{src: c.config.TokenSource(ctx, c.token)}
+		{{- end}}
+		{{- if or .RefreshHook .TokenStore}}
+		src = &hookSource{c: c, src: src, last: c.token}
+		{{- end}}
+		{{- if and .Safe .Token}}
+		src = &tokenTracker{c: c, src: src}
+		{{- end}}
+		{{- if .Leeway}}
+		// the client caches tokens until the leeway before their expiry
+		src = oauth2.ReuseTokenSourceWithExpiry(nil, src, c.expiryLeeway)
+		{{- end}}
+		{{- if .Token}}
+		c.source = src
+		{{- end}}
+		c.client.Transport = &oauth2.Transport{Source: src, Base: c.client.Transport}
 		return nil
 	}
 }
-
-{{if .Do}}
-// do executes the http request and populates v with the result.
-func (c *Client) do(req *http.Request, v interface{}) error {
-	ctx := req.Context()
-	res, err := c.client.Do(req)
-	if err != nil {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			return err
+{{end}}
+{{if .Leeway}}
+// WithTokenExpiryLeeway refreshes tokens the duration before they expire rather than
+// when they expire, to avoid using a token which expires in flight on slow networks.
+// Use this option before WithAutoRefresh.
+func WithTokenExpiryLeeway(d time.Duration) Option {
+	return func(c *Client) error {
+		if d < 0 {
+			return errors.New("expiry leeway must not be negative")
 		}
+		c.expiryLeeway = d
+		return nil
 	}
-	defer res.Body.Close()
+}
 
-	httpError := res.StatusCode >= http.StatusBadRequest
+// leewaySource refreshes the token when it is within the leeway of its expiry
+type leewaySource struct {
+	ctx    context.Context
+	config oauth2.Config
+	leeway time.Duration
+	now    func() time.Time
+	mu     sync.Mutex
+	token  *oauth2.Token
+}
 
-	var obj interface{}
-	if httpError {
-		obj = &Fault{}
-	} else {
-		obj = v
+func (s *leewaySource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != nil && s.token.AccessToken != "" &&
+		(s.token.Expiry.IsZero() || s.now().Add(s.leeway).Before(s.token.Expiry)) {
+		return s.token, nil
+	}
+	var refresh string
+	if s.token != nil {
+		refresh = s.token.RefreshToken
 	}
+	// a token without an access token is always refreshed
+	token, err := s.config.TokenSource(s.ctx, &oauth2.Token{RefreshToken: refresh}).Token()
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return token, nil
+}
+{{end}}
+{{if .TokenStore}}
+// TokenStore loads and saves tokens between runs
+type TokenStore interface {
+	// Load returns the stored token or nil if none has been saved
+	Load() (*oauth2.Token, error)
+	// Save stores the token
+	Save(token *oauth2.Token) error
+}
 
-	if obj != nil {
-		err := {{.Decoder}}.NewDecoder(res.Body).Decode(obj)
-		if err == io.EOF {
-			err = nil // ignore EOF errors caused by empty response body
+// WithTokenStore sets the client's token from the store, if one has been saved, and
+// saves refreshed tokens to the store. Use this option before WithAutoRefresh.
+func WithTokenStore(store TokenStore) Option {
+	return func(c *Client) error {
+		if store == nil {
+			return errors.New("nil token store")
 		}
-		if httpError {
-			switch q := obj.(type) {
-			case *Fault:
-				if q.Code == 0 {
-					q.Code = res.StatusCode
-				}
-				if q.Message == "" {
-					q.Message = http.StatusText(res.StatusCode)
-				}
-				return q
-			case error:
-				return q
-			default:
-				return q.(error)
+		token, err := store.Load()
+		if err != nil {
+			return err
+		}
+		if token != nil {
+			c.token = token
+		}
+		hook := c.refreshHook
+		c.refreshHook = func(token *oauth2.Token) error {
+			if err := store.Save(token); err != nil {
+				return err
+			}
+			if hook != nil {
+				return hook(token)
 			}
+			return nil
 		}
-		return err
+		return nil
+	}
+}
+
+// NewMemoryTokenStore returns a TokenStore holding the token in memory
+func NewMemoryTokenStore() TokenStore {
+	return &memoryTokenStore{}
+}
+
+type memoryTokenStore struct {
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (s *memoryTokenStore) Load() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == nil {
+		return nil, nil
 	}
+	token := *s.token
+	return &token, nil
+}
 
+func (s *memoryTokenStore) Save(token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := *token
+	s.token = &t
 	return nil
 }
-{{end}}`
-)
 
-func format(ctx context.Context, file string) error {
-	cmds := []*exec.Cmd{
-		exec.CommandContext(ctx, "gofmt", "-w", "-s", file),
-		exec.CommandContext(ctx, "goimports", "-w", file),
+// NewFileTokenStore returns a TokenStore saving the token as json in the file,
+// readable only by the current user
+func NewFileTokenStore(path string) TokenStore {
+	return &fileTokenStore{path: path}
+}
+
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) Load() (*oauth2.Token, error) {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
 	}
-	for _, cmd := range cmds {
-		b, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Fprintln(os.Stderr, strings.TrimSpace(string(b)))
-			return err
-		}
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(b, token); err != nil {
+		return nil, fmt.Errorf("token store %s: %w", s.path, err)
+	}
+	return token, nil
 }
 
-func generate(w with, file, tmpl string) error {
-	t, err := template.New("genwith").Parse(tmpl)
+// Save writes the token to a temporary file renamed over the file so a failed
+// write never leaves a partial token
+func (s *fileTokenStore) Save(token *oauth2.Token) error {
+	b, err := json.Marshal(token)
 	if err != nil {
-		log.Error().Err(err).Msg("parsing template")
 		return err
 	}
-	src := new(bytes.Buffer)
-	err = t.Execute(src, w)
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".token-*")
 	if err != nil {
-		log.Error().Err(err).Msg("executing template")
 		return err
 	}
-	return os.WriteFile(file, src.Bytes(), 0600)
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
 }
-
-func main() {
-	app := &cli.App{
-		Name:     "genwith",
-		Usage:    "Generate new functional option clients",
-		HelpName: "genwith",
-		Flags: []cli.Flag{
-			&cli.BoolFlag{
+{{end}}
+{{if .RefreshHook}}
+// WithTokenRefreshHook calls hook with each refreshed token, such as to persist it
+// between runs, an error from the hook fails the request and the hook is retried
+// on the next request
+func WithTokenRefreshHook(hook func(*oauth2.Token) error) Option {
+	return func(c *Client) error {
+		if hook == nil {
+			return errors.New("nil refresh hook")
+		}
+		c.refreshHook = hook
+		return nil
+	}
+}
+{{end}}
+{{if or .RefreshHook .TokenStore}}
+// hookSource calls the client's refresh hook when the source returns a new token, the
+// source is called while holding the lock so a token returned before a refresh is not
+// passed to the hook after the refreshed token
+type hookSource struct {
+	c    *Client
+	src  oauth2.TokenSource
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func (s *hookSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if s.c.refreshHook == nil || (s.last != nil &&
+		s.last.AccessToken == token.AccessToken && s.last.RefreshToken == token.RefreshToken) {
+		return token, nil
+	}
+	if err := s.c.refreshHook(token); err != nil {
+		return nil, fmt.Errorf("token refresh hook: %w", err)
+	}
+	s.last = token
+	return token, nil
+}
+{{end}}
+{{if .PKCE}}
+// AuthCodeURLWithPKCE returns the url of the provider's consent page with a PKCE challenge
+// and the code verifier to use with ExchangeWithPKCE
+func (c *Client) AuthCodeURLWithPKCE(state string, opts ...oauth2.AuthCodeOption) (authURL, verifier string) {
+	verifier = oauth2.GenerateVerifier()
+	return c.config.AuthCodeURL(state, append(opts, oauth2.S256ChallengeOption(verifier))...), verifier
+}
+
+// ExchangeWithPKCE converts the authorization code into a token using the code verifier
+// from AuthCodeURLWithPKCE{{if .Token}}, the token is used by the client for subsequent requests{{end}}
+func (c *Client) ExchangeWithPKCE(ctx context.Context, code, verifier string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return c.Exchange(ctx, code, append(opts, oauth2.VerifierOption(verifier))...)
+}
+{{end}}
+{{if .DeviceFlow}}
+// DeviceAuth starts the device authorization flow, the user visits the response's
+// VerificationURI and enters the UserCode while PollToken waits for approval
+func (c *Client) DeviceAuth(ctx context.Context, opts ...oauth2.AuthCodeOption) (*oauth2.DeviceAuthResponse, error) {
+	return c.config.DeviceAuth(ctx, opts...)
+}
+
+// PollToken polls the provider at the interval of the device authorization response
+// until the user approves or denies the request, or the device code expires{{if .Token}}, the
+// token is used by the client for subsequent requests{{end}}
+func (c *Client) PollToken(ctx context.Context, da *oauth2.DeviceAuthResponse, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	token, err := c.config.DeviceAccessToken(ctx, da, opts...)
+	if err != nil {
+		return nil, err
+	}
+	{{- if .Token}}
+	{{- if .Safe}}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	{{- end}}
+	c.token = token
+	{{- end}}
+	return token, nil
+}
+{{end}}
+{{if .TwoLegged}}
+// WithClientCredentialsFlow authenticates the client itself, rather than a user, with
+// the oauth2 client credentials flow, requesting new tokens as they expire.
+// The order of this option matters because it is dependent on the client's
+// config. Use this option after WithConfig or WithClientCredentials.
+func WithClientCredentialsFlow(ctx context.Context) Option {
+	return func(c *Client) error {
+		cfg := clientcredentials.Config{
+			ClientID:     c.config.ClientID,
+			ClientSecret: c.config.ClientSecret,
+			TokenURL:     c.config.Endpoint.TokenURL,
+			Scopes:       c.config.Scopes,
+			AuthStyle:    c.config.Endpoint.AuthStyle,
+		}
+		if cfg.TokenURL == "" {
+			return errors.New("client credentials flow requires a token url")
+		}
+		var src oauth2.TokenSource = &reauthSource{src: cfg.TokenSource(ctx)}
+		{{- if .Token}}
+		c.source = src
+		{{- end}}
+		c.client.Transport = &oauth2.Transport{Source: src, Base: c.client.Transport}
+		return nil
+	}
+}
+{{end}}
+{{end}}
+
+{{if or .Token .Endpoint .EndpointFunc .Providers .TwoLegged .JWT}}
+// ErrReauthenticationRequired is returned when the authorization server rejects a
+// token refresh because the grant is no longer valid and the user must log in again
+var ErrReauthenticationRequired = errors.New("reauthentication required")
+
+// reauthError wraps the refresh error so it matches ErrReauthenticationRequired
+type reauthError struct {
+	err error
+}
+
+func (e *reauthError) Error() string {
+	return ErrReauthenticationRequired.Error() + ": " + e.err.Error()
+}
+
+func (e *reauthError) Is(target error) bool {
+	return target == ErrReauthenticationRequired
+}
+
+func (e *reauthError) Unwrap() error {
+	return e.err
+}
+
+// reauthSource classifies token refresh failures requiring the user to log in again
+type reauthSource struct {
+	src oauth2.TokenSource
+}
+
+func (s *reauthSource) Token() (*oauth2.Token, error) {
+	token, err := s.src.Token()
+	if err != nil {
+		var re *oauth2.RetrieveError
+		if errors.As(err, &re) && (re.ErrorCode == "invalid_grant" || re.ErrorCode == "unauthorized_client") {
+			return nil, &reauthError{err: err}
+		}
+		return nil, err
+	}
+	return token, nil
+}
+{{end}}
+
+{{if .Token}}
+// WithToken sets the underlying oauth2.Token.
+func WithToken(token *oauth2.Token) Option {
+	return func(c *Client) error {
+		if c.source != nil {
+			return errTokenAfterSource
+		}
+		{{- if .Safe}}
+		if token == nil {
+			return errors.New("nil token")
+		}
+		t := *token
+		c.token = &t
+		{{- else}}
+		c.token = token
+		{{- end}}
+		return nil
+	}
+}
+
+// WithTokenCredentials provides the tokens for an authenticated user.
+func WithTokenCredentials(accessToken, refreshToken string, expiry time.Time) Option {
+	return func(c *Client) error {
+		if c.source != nil {
+			return errTokenAfterSource
+		}
+		c.token = &oauth2.Token{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			Expiry:       expiry,
+		}
+		return nil
+	}
+}
+
+// errTokenAfterSource is returned when a token is set after requests are authorized by
+// a token source, which would not use it
+var errTokenAfterSource = errors.New("token follows an option authorizing requests with a token source, apply it first")
+
+// WithTokenSource authorizes requests with tokens from the source, such as a keyring
+// or remote service, in place of the client's token
+func WithTokenSource(src oauth2.TokenSource) Option {
+	return func(c *Client) error {
+		if src == nil {
+			return errors.New("nil token source")
+		}
+		src = &reauthSource{src: oauth2.ReuseTokenSource(nil, src)}
+		c.source = src
+		c.client.Transport = &oauth2.Transport{Source: src, Base: c.client.Transport}
+		return nil
+	}
+}
+{{end}}
+
+{{if .RateLimiter}}
+// WithRateLimiter rate limits the client's api calls
+func WithRateLimiter(r *rate.Limiter) Option {
+	return func(c *Client) error {
+		if r == nil {
+			return errors.New("nil limiter")
+		}
+		{{- if or .Expvar .Clock}}
+		c.client.Transport = &keyedRateLimitTransport{
+			{{- if .Clock}}
+			c:         c,
+			{{- end}}
+			key:       func(*http.Request) string { return "" },
+			limiters:  map[string]*rate.Limiter{"": r},
+			transport: c.client.Transport,
+		}
+		{{- else}}
+		c.client.Transport = &httpwares.RateLimitTransport{
+			Limiter:   r,
+			Transport: c.client.Transport,
+		}
+		{{- end}}
+		return nil
+	}
+}
+
+// WithRateLimit rate limits the client's api calls to rps requests per second with bursts
+// of up to burst requests
+func WithRateLimit(rps float64, burst int) Option {
+	return func(c *Client) error {
+		if rps <= 0 || burst <= 0 {
+			return errors.New("rate limit and burst must be positive")
+		}
+		return WithRateLimiter(rate.NewLimiter(rate.Limit(rps), burst))(c)
+	}
+}
+
+{{- if .Clock}}
+
+// waitLimiter waits for the limiter to permit a request at the times of the client's clock
+func (c *Client) waitLimiter(ctx context.Context, limiter *rate.Limiter) error {
+	r := limiter.ReserveN(c.now(), 1)
+	if !r.OK() {
+		return errors.New("rate limiter does not permit a request")
+	}
+	if err := c.sleep(ctx, r.DelayFrom(c.now())); err != nil {
+		r.CancelAt(c.now())
+		return err
+	}
+	return nil
+}
+{{- end}}
+
+// RateKey returns the rate limiting bucket for a request, such as its route template or operation name
+type RateKey func(req *http.Request) string
+
+// WithKeyedRateLimiter rate limits the client's api calls with an independent limiter
+// for each bucket returned by key, for apis with per-route or per-operation quotas
+func WithKeyedRateLimiter(key RateKey, limit rate.Limit, burst int) Option {
+	return func(c *Client) error {
+		if key == nil {
+			return errors.New("nil rate key")
+		}
+		c.client.Transport = &keyedRateLimitTransport{
+			{{- if .Clock}}
+			c:         c,
+			{{- end}}
+			key:       key,
+			limit:     limit,
+			burst:     burst,
+			limiters:  make(map[string]*rate.Limiter),
+			transport: c.client.Transport,
+		}
+		return nil
+	}
+}
+
+// WithRateLimiters rate limits the client's api calls with the limiter whose key is the
+// longest match of the request, for clients of more than one host with independent quotas.
+// A key is a host, such as "api.example.com", or a host and path prefix, such as
+// "api.example.com/v1/uploads". Requests matching no key are not limited.
+func WithRateLimiters(limiters map[string]*rate.Limiter) Option {
+	return func(c *Client) error {
+		m := map[string]*rate.Limiter{"": rate.NewLimiter(rate.Inf, 0)}
+		keys := make([]string, 0, len(limiters))
+		for key, limiter := range limiters {
+			if key == "" || limiter == nil {
+				return fmt.Errorf("invalid limiter for key '%s'", key)
+			}
+			m[key] = limiter
+			keys = append(keys, key)
+		}
+		// the longest key is the most specific match
+		sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+		c.client.Transport = &keyedRateLimitTransport{
+			{{- if .Clock}}
+			c: c,
+			{{- end}}
+			key: func(req *http.Request) string {
+				target := req.URL.Host + req.URL.Path
+				for _, key := range keys {
+					if strings.HasPrefix(target, key) &&
+						(len(target) == len(key) || target[len(key)] == '/' || strings.HasSuffix(key, "/")) {
+						return key
+					}
+				}
+				return ""
+			},
+			limiters:  m,
+			transport: c.client.Transport,
+		}
+		return nil
+	}
+}
+
+// keyedRateLimitTransport lazily creates a limiter for each bucket
+type keyedRateLimitTransport struct {
+	{{- if .Clock}}
+	c         *Client
+	{{- end}}
+	key       RateKey
+	limit     rate.Limit
+	burst     int
+	mu        sync.Mutex
+	limiters  map[string]*rate.Limiter
+	transport http.RoundTripper
+}
+
+func (t *keyedRateLimitTransport) limiter(key string) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	limiter, ok := t.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(t.limit, t.burst)
+		t.limiters[key] = limiter
+	}
+	return limiter
+}
+
+func (t *keyedRateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	{{- if .Expvar}}
+	start := time.Now()
+	{{- end}}
+	{{- if .Clock}}
+	if err := t.c.waitLimiter(req.Context(), t.limiter(t.key(req))); err != nil {
+	{{- else}}
+	if err := t.limiter(t.key(req)).Wait(req.Context()); err != nil {
+	{{- end}}
+		return nil, err
+	}
+	{{- if .Expvar}}
+	if vars, ok := req.Context().Value(expvarKey{}).(*expvar.Map); ok {
+		vars.AddFloat("rate_limit_wait_seconds", time.Since(start).Seconds())
+	}
+	{{- end}}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+{{- if .RetryAfter}}
+
+// WithRetryAfter pauses requests until the delay of the Retry-After header of a 429 Too
+// Many Requests or 503 Service Unavailable response has passed, retrying the request up
+// to max times, or none to return the response. Use this option after WithRateLimiter.
+func WithRetryAfter(max int) Option {
+	return func(c *Client) error {
+		if max < 0 {
+			return errors.New("max retries must not be negative")
+		}
+		c.client.Transport = &retryAfterTransport{c: c, max: max, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// retryAfterTransport holds requests while the server asks the client to back off
+type retryAfterTransport struct {
+	c         *Client
+	max       int
+	mu        sync.Mutex
+	until     time.Time
+	transport http.RoundTripper
+}
+
+// pause holds requests until the time
+func (t *retryAfterTransport) pause(until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until.After(t.until) {
+		t.until = until
+	}
+}
+
+// wait returns when requests are no longer paused or ctx is done
+func (t *retryAfterTransport) wait(ctx context.Context) error {
+	t.mu.Lock()
+	d := t.until.Sub(t.c.now())
+	t.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	return t.c.sleep(ctx, d)
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(ctx); err != nil {
+			return nil, err
+		}
+		r := req
+		if attempt > 0 {
+			r = req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
+		res, err := transport.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+			return res, nil
+		}
+		delay, ok := retryAfter(res.Header.Get("Retry-After"), t.c.now())
+		if !ok {
+			return res, nil
+		}
+		t.pause(t.c.now().Add(delay))
+		// a request body which cannot be replayed can only be sent once
+		if attempt == t.max || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			return res, nil
+		}
+		// drain the body so the connection can be reused
+		_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+		res.Body.Close()
+	}
+}
+
+// retryAfter returns the delay of a Retry-After header given in seconds or as an http date
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+{{- end}}
+{{- if .Adaptive}}
+
+// WithAdaptiveRateLimiter rate limits the client's api calls with the limiter, adjusting
+// its limit to spread the requests remaining, from the X-RateLimit-Remaining header, over
+// the time until the quota resets, from the X-RateLimit-Reset header as a unix time or
+// seconds. The lowest rate is used for headers listing more than one window.
+func WithAdaptiveRateLimiter(r *rate.Limiter) Option {
+	return func(c *Client) error {
+		if r == nil {
+			return errors.New("nil limiter")
+		}
+		c.client.Transport = &adaptiveRateLimitTransport{c: c, limiter: r, burst: r.Burst(), transport: c.client.Transport}
+		return nil
+	}
+}
+
+// adaptiveRateLimitTransport adjusts the limiter from the rate limit headers of responses
+type adaptiveRateLimitTransport struct {
+	c         *Client
+	limiter   *rate.Limiter
+	burst     int
+	transport http.RoundTripper
+}
+
+func (t *adaptiveRateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	{{- if .Clock}}
+	if err := t.c.waitLimiter(req.Context(), t.limiter); err != nil {
+	{{- else}}
+	if err := t.limiter.Wait(req.Context()); err != nil {
+	{{- end}}
+		return nil, err
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.adapt(res.Header)
+	return res, nil
+}
+
+// adapt sets the limit and burst of the limiter from the rate limit headers
+func (t *adaptiveRateLimitTransport) adapt(header http.Header) {
+	remaining := strings.Split(header.Get("X-RateLimit-Remaining"), ",")
+	reset := strings.Split(header.Get("X-RateLimit-Reset"), ",")
+	now := t.c.now()
+	limit, burst := rate.Inf, t.burst
+	for i := 0; i < len(remaining) && i < len(reset); i++ {
+		n, err := strconv.Atoi(strings.TrimSpace(remaining[i]))
+		if err != nil || n < 0 {
+			continue
+		}
+		at, err := strconv.ParseInt(strings.TrimSpace(reset[i]), 10, 64)
+		if err != nil {
+			continue
+		}
+		until := time.Duration(at) * time.Second
+		if at > 1e9 {
+			// a unix time rather than a number of seconds
+			until = time.Unix(at, 0).Sub(now)
+		}
+		if until <= 0 {
+			continue
+		}
+		if n == 0 {
+			// allow a single request once the quota resets
+			n = 1
+		}
+		if l := rate.Limit(float64(n) / until.Seconds()); l < limit {
+			limit = l
+			if n < burst {
+				burst = n
+			}
+		}
+	}
+	if limit == rate.Inf {
+		return
+	}
+	t.limiter.SetLimitAt(now, limit)
+	t.limiter.SetBurstAt(now, burst)
+}
+{{- end}}
+{{end}}
+{{- if .Concurrency}}
+
+// WithMaxConcurrency limits the client to at most n requests in flight, a request holds
+// its slot until the response body is closed{{if .WebSocket}}, and a websocket connection until it is closed{{end}}
+func WithMaxConcurrency(n int) Option {
+	return func(c *Client) error {
+		if n <= 0 {
+			return errors.New("max concurrency must be positive")
+		}
+		c.client.Transport = &concurrencyTransport{sem: make(chan struct{}, n), transport: c.client.Transport}
+		return nil
+	}
+}
+
+// concurrencyTransport limits the number of requests in flight
+type concurrencyTransport struct {
+	sem       chan struct{}
+	transport http.RoundTripper
+}
+
+func (t *concurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	case t.sem <- struct{}{}:
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		<-t.sem
+		return nil, err
+	}
+	release := func() { <-t.sem }
+	if conn, ok := res.Body.(io.ReadWriteCloser); ok {
+		// the embedded field is renamed with its type for client variants
+		res.Body = &releaseConn{releaseBody{ReadCloser: conn, release: release}, conn}
+		return res, nil
+	}
+	res.Body = &releaseBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+// releaseBody releases the request's slot once when the body is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// releaseConn is the releaseBody of a switching protocols response, such as a websocket
+// handshake, whose body is the connection and remains writable
+type releaseConn struct {
+	releaseBody
+	io.Writer
+}
+{{- end}}
+
+// WithHTTPTracing enables tracing http calls.
+func WithHTTPTracing(debug bool) Option {
+	return func(c *Client) error {
+		if !debug {
+			return nil
+		}
+		{{- if .Minimal}}
+		c.client.Transport = &verboseTransport{transport: c.client.Transport}
+		{{- else}}
+		c.client.Transport = &httpwares.VerboseTransport{
+			Transport: c.client.Transport,
+		}
+		{{- end}}
+		return nil
+	}
+}
+
+{{if .Minimal}}
+// verboseTransport writes requests and responses to stderr
+type verboseTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *verboseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if b, err := httputil.DumpRequestOut(req, true); err == nil {
+		fmt.Fprintln(os.Stderr, string(b))
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := httputil.DumpResponse(res, true); err == nil {
+		fmt.Fprintln(os.Stderr, string(b))
+	}
+	return res, nil
+}
+{{end}}
+
+// WithTransport sets the underlying http client transport.
+func WithTransport(t http.RoundTripper) Option {
+	return func(c *Client) error {
+		if t == nil {
+			return errors.New("nil transport")
+		}
+		c.client.Transport = t
+		{{- if .Token}}
+		// requests are no longer authorized with the token source
+		c.source = nil
+		{{- end}}
+		return nil
+	}
+}
+
+// WithHTTPClient sets the underlying http client.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) error {
+		if client == nil {
+			return errors.New("nil client")
+		}
+		c.client = client
+		{{- if .Token}}
+		// requests are no longer authorized with the token source
+		c.source = nil
+		{{- end}}
+		return nil
+	}
+}
+{{if .Middleware}}
+// WithMiddleware wraps the client's transport with the middleware, the first middleware is
+// the outermost and sees requests first. The transports of earlier options are wrapped by
+// the middleware and those of later options wrap it.
+func WithMiddleware(mw ...func(http.RoundTripper) http.RoundTripper) Option {
+	return func(c *Client) error {
+		transport := c.client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		for i := len(mw) - 1; i >= 0; i-- {
+			if mw[i] == nil {
+				return errors.New("nil middleware")
+			}
+			if transport = mw[i](transport); transport == nil {
+				return errors.New("middleware returned a nil transport")
+			}
+		}
+		c.client.Transport = transport
+		return nil
+	}
+}
+{{end}}
+
+{{if .Retry}}
+type retryUnsafeKey struct{}
+
+// RetryUnsafe returns a context whose requests are retried even if their method is
+// not idempotent, for calls the api documents as safe to repeat
+func RetryUnsafe(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryUnsafeKey{}, true)
+}
+
+// WithRetry retries requests failing with a transport error or a transient status up
+// to max times, waiting backoff before the first retry and doubling it after each
+// unless another strategy is set with WithBackoff.
+// Only requests with idempotent methods are retried unless the context is from RetryUnsafe.
+func WithRetry(max int, backoff time.Duration) Option {
+	return func(c *Client) error {
+		if max < 0 {
+			return errors.New("max retries must not be negative")
+		}
+		c.client.Transport = &retryTransport{
+			c:         c,
+			max:       max,
+			backoff:   ExponentialBackoff(backoff, 0, 0),
+			transport: c.client.Transport,
+		}
+		return nil
+	}
+}
+
+// Backoff computes the delay before a retry
+type Backoff interface {
+	// Delay returns the delay following the attempt, the first attempt is zero
+	Delay(attempt int) time.Duration
+}
+
+// WithBackoff sets the strategy for the delay between retries
+func WithBackoff(strategy Backoff) Option {
+	return func(c *Client) error {
+		if strategy == nil {
+			return errors.New("nil backoff")
+		}
+		c.backoff = strategy
+		return nil
+	}
+}
+
+// backoffFunc adapts a function to the Backoff interface
+type backoffFunc func(attempt int) time.Duration
+
+func (f backoffFunc) Delay(attempt int) time.Duration {
+	return f(attempt)
+}
+
+// jitter randomly reduces the delay by up to the fraction
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d - time.Duration(fraction*rand.Float64()*float64(d))
+}
+
+// ConstantBackoff waits the same delay before each retry, randomly reduced by up to the jitter fraction
+func ConstantBackoff(delay time.Duration, fraction float64) Backoff {
+	return backoffFunc(func(int) time.Duration {
+		return jitter(delay, fraction)
+	})
+}
+
+// LinearBackoff increases the delay by step after each attempt, randomly reduced by up to the jitter fraction
+func LinearBackoff(step time.Duration, fraction float64) Backoff {
+	return backoffFunc(func(attempt int) time.Duration {
+		return jitter(step*time.Duration(attempt+1), fraction)
+	})
+}
+
+// ExponentialBackoff doubles the delay after each attempt up to max, if positive, randomly
+// reduced by up to the jitter fraction
+func ExponentialBackoff(base, max time.Duration, fraction float64) Backoff {
+	return backoffFunc(func(attempt int) time.Duration {
+		d := base
+		for i := 0; i < attempt && d < math.MaxInt64/2; i++ {
+			d *= 2
+		}
+		if max > 0 && d > max {
+			d = max
+		}
+		return jitter(d, fraction)
+	})
+}
+
+// idempotent returns true if repeating the request has no additional side effects
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	unsafe, _ := req.Context().Value(retryUnsafeKey{}).(bool)
+	return unsafe
+}
+
+// transient returns true if the request failed but may succeed if retried
+func transient(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryTransport retries transient failures of idempotent requests
+type retryTransport struct {
+	c         *Client
+	max       int
+	backoff   Backoff
+	transport http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	// a request body which cannot be replayed can only be sent once
+	if !idempotent(req) || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return transport.RoundTrip(req)
+	}
+	backoff := t.backoff
+	if t.c.backoff != nil {
+		backoff = t.c.backoff
+	}
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 {
+			r = req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
+		res, err := transport.RoundTrip(r)
+		if attempt == t.max || !transient(res, err) {
+			return res, err
+		}
+		if res != nil {
+			// drain the body so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+			res.Body.Close()
+		}
+		delay := backoff.Delay(attempt)
+		{{- if .RetryAfter}}
+		// wait at least as long as the server asks
+		if res != nil {
+			if d, ok := retryAfter(res.Header.Get("Retry-After"), t.c.now()); ok && d > delay {
+				delay = d
+			}
+		}
+		{{- end}}
+		if err := t.c.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+		{{- if .Stats}}
+		if stat, ok := ctx.Value(statKey{}).(*Stat); ok {
+			stat.Attempts++
+		}
+		{{- end}}
+	}
+}
+{{end}}
+
+{{if .Breaker}}
+// ErrCircuitOpen is returned without sending the request while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// WithCircuitBreaker stops sending requests for the cooldown after threshold consecutive
+// failures, a transport error or a server error status, then allows a single trial
+// request whose success closes the circuit
+{{- if .Health}}. The circuit of each endpoint class opens from
+// the failures of its requests recorded by the health tracker, allowing a trial request
+// each cooldown.
+{{- end}}
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *Client) error {
+		if threshold <= 0 {
+			return errors.New("threshold must be positive")
+		}
+		c.client.Transport = &breakerTransport{
+			threshold: threshold,
+			cooldown:  cooldown,
+			now:       c.now,
+			{{- if .Health}}
+			health:    c.health,
+			{{- end}}
+			transport: c.client.Transport,
+		}
+		return nil
+	}
+}
+
+// breakerTransport fails fast while the upstream is degraded
+type breakerTransport struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	{{- if .Health}}
+	health    *{{.Ident "health"}}
+	{{- else}}
+	mu        sync.Mutex
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	{{- end}}
+	transport http.RoundTripper
+}
+
+// allow returns true if the request may be sent
+func (t *breakerTransport) allow(req *http.Request) bool {
+	{{- if .Health}}
+	return t.health.allow(endpointClass(req), t.threshold, t.cooldown, t.now())
+	{{- else}}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failures < t.threshold {
+		return true
+	}
+	if t.trial || t.now().Sub(t.openedAt) < t.cooldown {
+		return false
+	}
+	t.trial = true
+	return true
+	{{- end}}
+}
+{{- if not .Health}}
+
+// record the outcome of a request
+func (t *breakerTransport) record(failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.trial = false
+	if !failed {
+		t.failures = 0
+		return
+	}
+	t.failures++
+	if t.failures >= t.threshold {
+		t.openedAt = t.now()
+	}
+}
+{{- end}}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.allow(req) {
+		return nil, ErrCircuitOpen
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	{{- if .Health}}
+	// the client records the outcome with the health tracker
+	return transport.RoundTrip(req)
+	{{- else}}
+	res, err := transport.RoundTrip(req)
+	if errors.Is(err, context.Canceled) {
+		// requests canceled by the caller say nothing about the upstream
+		t.mu.Lock()
+		t.trial = false
+		t.mu.Unlock()
+		return res, err
+	}
+	t.record(err != nil || res.StatusCode >= http.StatusInternalServerError)
+	return res, err
+	{{- end}}
+}
+{{end}}
+
+{{if .Metrics}}
+// WithMetrics registers prometheus metrics recording the count and duration of requests
+// by method and status code class, clients sharing a registerer share the metrics
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(c *Client) error {
+		if registerer == nil {
+			return errors.New("nil registerer")
+		}
+		requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "{{.Package}}",
+			Name:      "requests_total",
+			Help:      "The number of http requests by method and status code class.",
+		}, []string{"method", "code"})
+		if err := register({{if .Rollback}}c, {{end}}registerer, &requests); err != nil {
+			return err
+		}
+		durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "{{.Package}}",
+			Name:      "request_duration_seconds",
+			Help:      "The duration of http requests by method and status code class.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "code"})
+		if err := register({{if .Rollback}}c, {{end}}registerer, &durations); err != nil {
+			return err
+		}
+		c.client.Transport = &metricsTransport{
+			requests:  requests,
+			durations: durations,
+			transport: c.client.Transport,
+		}
+		return nil
+	}
+}
+
+// register the collector, replacing it with an equivalent collector already registered
+{{- if .Rollback}}, and
+// unregisters a collector it registered if NewClient fails
+func register[T prometheus.Collector](c *Client, registerer prometheus.Registerer, collector *T) error {
+	err := registerer.Register(*collector)
+	if err == nil {
+		registered := *collector
+		c.onTeardown(func() { registerer.Unregister(registered) })
+		return nil
+	}
+{{- else}}
+func register[T prometheus.Collector](registerer prometheus.Registerer, collector *T) error {
+	err := registerer.Register(*collector)
+{{- end}}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		existing, ok := are.ExistingCollector.(T)
+		if !ok {
+			return err
+		}
+		*collector = existing
+		return nil
+	}
+	return err
+}
+
+// metricsTransport records prometheus metrics for each request
+type metricsTransport struct {
+	requests  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+	transport http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	start := time.Now()
+	res, err := transport.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = fmt.Sprintf("%dxx", res.StatusCode/100)
+	}
+	t.requests.WithLabelValues(req.Method, code).Inc()
+	t.durations.WithLabelValues(req.Method, code).Observe(time.Since(start).Seconds())
+	return res, err
+}
+{{end}}
+
+{{if or .Proxy .TLS}}
+// httpTransport returns a copy of the client's *http.Transport, or http.DefaultTransport
+// if none is set, installed as the client's transport so it can be configured
+func httpTransport(c *Client) (*http.Transport, error) {
+	var t *http.Transport
+	switch transport := c.client.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = transport.Clone()
+	default:
+		return nil, errors.New("the client's transport is not an *http.Transport, apply this option first")
+	}
+	c.client.Transport = t
+	return t, nil
+}
+{{end}}
+
+{{if .BasicAuth}}
+// WithBasicAuth authenticates every request with http basic authentication
+func WithBasicAuth(username, password string) Option {
+	return func(c *Client) error {
+		c.client.Transport = &basicAuthTransport{username: username, password: password, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// basicAuthTransport sets the Authorization header of requests
+type basicAuthTransport struct {
+	username  string
+	password  string
+	transport http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, t.password)
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if .Bearer}}
+// WithBearerToken authenticates every request with the static bearer token
+func WithBearerToken(token string) Option {
+	return func(c *Client) error {
+		if token == "" {
+			return errors.New("empty bearer token")
+		}
+		c.client.Transport = &bearerTransport{token: token, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// bearerTransport sets the Authorization header of requests
+type bearerTransport struct {
+	token     string
+	transport http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if or .HMAC .SigV4 .OAuth1}}
+// bufferBody returns a copy of the request with its body read into memory for signing
+func bufferBody(req *http.Request) (*http.Request, []byte, error) {
+	req = req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return req, body, nil
+}
+{{end}}
+
+{{if .JWT}}
+// WithJWTAssertion authorizes requests with tokens exchanged at the token url for
+// assertions signed by the PEM encoded private key, such as a service account, with
+// the scopes. The audience defaults to the token url if empty. The context is used
+// when exchanging assertions, such as for its oauth2.HTTPClient.
+func WithJWTAssertion(ctx context.Context, keyPEM []byte, issuer, audience, tokenURL string, scopes ...string) Option {
+	return func(c *Client) error {
+		if len(keyPEM) == 0 {
+			return errors.New("empty private key")
+		}
+		if tokenURL == "" {
+			return errors.New("empty token url")
+		}
+		cfg := &jwt.Config{
+			Email:      issuer,
+			PrivateKey: keyPEM,
+			Scopes:     scopes,
+			TokenURL:   tokenURL,
+			Audience:   audience,
+		}
+		var src oauth2.TokenSource = &reauthSource{src: cfg.TokenSource(ctx)}
+		{{- if .Token}}
+		c.source = src
+		{{- end}}
+		c.client.Transport = &oauth2.Transport{Source: src, Base: c.client.Transport}
+		return nil
+	}
+}
+{{end}}
+
+{{if .OAuth1}}
+// WithOAuth1 signs every request with oauth1 HMAC-SHA1 using the consumer and the
+// user's token credentials
+func WithOAuth1(consumerKey, consumerSecret, token, tokenSecret string) Option {
+	return func(c *Client) error {
+		if consumerKey == "" || consumerSecret == "" {
+			return errors.New("missing consumer key or secret")
+		}
+		c.client.Transport = &oauth1Transport{
+			consumerKey:    consumerKey,
+			consumerSecret: consumerSecret,
+			token:          token,
+			tokenSecret:    tokenSecret,
+			now:            c.now,
+			transport:      c.client.Transport,
+		}
+		return nil
+	}
+}
+
+// oauth1Transport signs requests as described in RFC 5849
+type oauth1Transport struct {
+	consumerKey    string
+	consumerSecret string
+	token          string
+	tokenSecret    string
+	now            func() time.Time
+	transport      http.RoundTripper
+}
+
+// percentEncode encodes the string as required by RFC 5849 section 3.6
+func percentEncode(s string) string {
+	return strings.NewReplacer("+", "%20", "*", "%2A", "%7E", "~").Replace(url.QueryEscape(s))
+}
+
+func (t *oauth1Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	nonce := make([]byte, 16)
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	oauth := map[string]string{
+		"oauth_consumer_key":     t.consumerKey,
+		"oauth_nonce":            hex.EncodeToString(nonce),
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        strconv.FormatInt(t.now().Unix(), 10),
+		"oauth_version":          "1.0",
+	}
+	if t.token != "" {
+		oauth["oauth_token"] = t.token
+	}
+
+	// the signature covers the oauth, query, and form parameters
+	params := req.URL.Query()
+	for key, value := range oauth {
+		params.Add(key, value)
+	}
+	req, body, err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range form {
+			params[key] = append(params[key], values...)
+		}
+	}
+	var pairs []string
+	for key, values := range params {
+		for _, value := range values {
+			pairs = append(pairs, percentEncode(key)+"="+percentEncode(value))
+		}
+	}
+	sort.Strings(pairs)
+	u := url.URL{Scheme: strings.ToLower(req.URL.Scheme), Host: strings.ToLower(req.URL.Host), Path: req.URL.Path}
+	base := req.Method + "&" + percentEncode(u.String()) + "&" + percentEncode(strings.Join(pairs, "&"))
+	mac := hmac.New(sha1.New, []byte(percentEncode(t.consumerSecret)+"&"+percentEncode(t.tokenSecret)))
+	mac.Write([]byte(base))
+	oauth["oauth_signature"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	keys := make([]string, 0, len(oauth))
+	for key := range oauth {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	header := make([]string, len(keys))
+	for i, key := range keys {
+		header[i] = key + "=\"" + percentEncode(oauth[key]) + "\""
+	}
+	req.Header.Set("Authorization", "OAuth "+strings.Join(header, ", "))
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if .SigV4}}
+// WithSigV4 signs every request with AWS Signature Version 4 using credentials from
+// the provider for the service and region
+func WithSigV4(credentials aws.CredentialsProvider, service, region string) Option {
+	return func(c *Client) error {
+		if credentials == nil {
+			return errors.New("nil credentials provider")
+		}
+		c.client.Transport = &sigv4Transport{
+			credentials: credentials,
+			service:     service,
+			region:      region,
+			signer:      v4.NewSigner(),
+			now:         c.now,
+			transport:   c.client.Transport,
+		}
+		return nil
+	}
+}
+
+// sigv4Transport signs requests with AWS Signature Version 4
+type sigv4Transport struct {
+	credentials aws.CredentialsProvider
+	service     string
+	region      string
+	signer      *v4.Signer
+	now         func() time.Time
+	transport   http.RoundTripper
+}
+
+func (t *sigv4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	req, body, err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := t.credentials.Retrieve(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(body)
+	err = t.signer.SignHTTP(req.Context(), creds, req, hex.EncodeToString(digest[:]), t.service, t.region, t.now())
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if .HMAC}}
+// WithHMACSigner signs every request with an hmac of the method, path and query, date,
+// and hex encoded digest of the body, each separated by a newline, using the secret and
+// hash. The signature is set in the {{.HMAC}} header as:
+//
+//	HMAC keyId="<keyID>",headers="(request-target) date digest",signature="<base64 signature>"
+func WithHMACSigner(keyID, secret string, hash func() hash.Hash) Option {
+	return func(c *Client) error {
+		if secret == "" {
+			return errors.New("empty hmac secret")
+		}
+		if hash == nil {
+			return errors.New("nil hash")
+		}
+		c.client.Transport = &hmacTransport{
+			keyID:     keyID,
+			secret:    []byte(secret),
+			hash:      hash,
+			now:       c.now,
+			transport: c.client.Transport,
+		}
+		return nil
+	}
+}
+
+// hmacTransport signs requests
+type hmacTransport struct {
+	keyID     string
+	secret    []byte
+	hash      func() hash.Hash
+	now       func() time.Time
+	transport http.RoundTripper
+}
+
+func (t *hmacTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	req, body, err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	digest := t.hash()
+	digest.Write(body)
+	date := req.Header.Get("Date")
+	if date == "" {
+		date = t.now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+	}
+	mac := hmac.New(t.hash, t.secret)
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + date + "\n" + hex.EncodeToString(digest.Sum(nil))))
+	req.Header.Set({{printf "%q" .HMAC}}, fmt.Sprintf("HMAC keyId=%q,headers=%q,signature=%q",
+		t.keyID, "(request-target) date digest", base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if .Proxy}}
+// WithProxy sends all requests through the proxy
+func WithProxy(proxyURL string) Option {
+	return func(c *Client) error {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("proxy url '%s' is not absolute", proxyURL)
+		}
+		t, err := httpTransport(c)
+		if err != nil {
+			return err
+		}
+		t.Proxy = http.ProxyURL(u)
+		return nil
+	}
+}
+
+// WithProxyFromEnvironment sends requests through the proxy configured by the
+// HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables
+func WithProxyFromEnvironment() Option {
+	return func(c *Client) error {
+		t, err := httpTransport(c)
+		if err != nil {
+			return err
+		}
+		t.Proxy = http.ProxyFromEnvironment
+		return nil
+	}
+}
+{{end}}
+
+{{if .TLS}}
+// tlsConfig returns a copy of the transport's tls configuration, installed on the
+// transport so it can be configured
+func tlsConfig(c *Client) (*tls.Config, error) {
+	t, err := httpTransport(c)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		config = t.TLSClientConfig.Clone()
+	}
+	t.TLSClientConfig = config
+	return config, nil
+}
+
+// WithTLSConfig sets the tls configuration of the client's transport
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) error {
+		if config == nil {
+			return errors.New("nil tls config")
+		}
+		t, err := httpTransport(c)
+		if err != nil {
+			return err
+		}
+		t.TLSClientConfig = config.Clone()
+		return nil
+	}
+}
+
+// WithInsecureSkipVerify disables verification of the server's certificate chain and
+// host name, only for testing against self-signed endpoints
+func WithInsecureSkipVerify() Option {
+	return func(c *Client) error {
+		config, err := tlsConfig(c)
+		if err != nil {
+			return err
+		}
+		config.InsecureSkipVerify = true //nolint:gosec
+		return nil
+	}
+}
+
+// WithRootCAs verifies server certificates with the pool of certificate authorities
+// rather than the system pool
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *Client) error {
+		if pool == nil {
+			return errors.New("nil cert pool")
+		}
+		config, err := tlsConfig(c)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = pool
+		return nil
+	}
+}
+
+// WithClientCertificate authenticates the client with the PEM encoded certificate and
+// key for servers requiring mutual tls
+func WithClientCertificate(certFile, keyFile string) Option {
+	return func(c *Client) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config, err := tlsConfig(c)
+		if err != nil {
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+		return nil
+	}
+}
+{{end}}
+
+{{if .Timeout}}
+// WithTimeout sets the time limit for requests made by the client, including reading
+// the response body. Use this option after WithHTTPClient, which replaces the http client.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) error {
+		if timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		c.client.Timeout = timeout
+		return nil
+	}
+}
+{{end}}
+
+{{if .BaseURL}}
+// WithBaseURL sets the url against which api request paths are resolved, the
+// default is {{.BaseURL}}
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) error {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("base url '%s' is not absolute", baseURL)
+		}
+		c.baseURL = u
+		return nil
+	}
+}
+
+// newAPIRequest returns a new request for the path, and optional query, joined to the base url
+func (c *Client) newAPIRequest(ctx context.Context, method, path string) (*http.Request, error) {
+	u, err := c.apiURL(path)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequestWithContext(ctx, method, u, nil)
+}
+
+// apiURL joins the path, and optional query, to the base url
+func (c *Client) apiURL(path string) (string, error) {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	u := c.baseURL.JoinPath(ref.Path)
+	u.RawQuery = ref.RawQuery
+	return u.String(), nil
+}
+{{end}}
+
+{{if .Encoder}}
+// newRequest returns a new request for the {{if .BaseURL}}path joined to the base url{{else}}url{{end}} with the body encoded
+// as {{.Encoder}}, a nil body sends no content
+func (c *Client) newRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		{{- if eq .Encoder "form"}}
+		values, ok := body.(url.Values)
+		if !ok {
+			return nil, fmt.Errorf("form body must be url.Values, not %T", body)
+		}
+		r = strings.NewReader(values.Encode())
+		{{- else}}
+		b, err := {{.Encoder}}.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+		{{- end}}
+	}
+	{{- if .BaseURL}}
+	u, err := c.apiURL(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	{{- else}}
+	req, err := http.NewRequestWithContext(ctx, method, path, r)
+	{{- end}}
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		{{- if eq .Encoder "form"}}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		{{- else}}
+		req.Header.Set("Content-Type", "application/{{.Encoder}}")
+		{{- end}}
+	}
+	return req, nil
+}
+{{end}}
+
+{{if .WebSocket}}
+// Dial opens a websocket connection to the {{if .BaseURL}}path joined to the base url{{else}}url{{end}}, the handshake is
+// made with the client's http client so it carries the same authorization as requests
+func (c *Client) Dial(ctx context.Context, {{if .BaseURL}}path{{else}}rawURL{{end}} string) (*websocket.Conn, error) {
+	{{- if .BaseURL}}
+	u, err := c.apiURL(path)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := websocket.Dial(ctx, u, &websocket.DialOptions{HTTPClient: c.client})
+	{{- else}}
+	conn, _, err := websocket.Dial(ctx, rawURL, &websocket.DialOptions{HTTPClient: c.client})
+	{{- end}}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+{{end}}
+
+{{if .Idempotency}}
+// WithIdempotencyKeys sets the header, Idempotency-Key if empty, of POST and PATCH requests
+// without one to a unique key from gen, or a random key if gen is nil, so the server
+// applies a repeated request only once.
+{{- if .Retry}}
+// Requests with a key are retried by WithRetry, use this option after WithRetry so each
+// retry of a request repeats its key.
+{{- end}}
+func WithIdempotencyKeys(header string, gen func() string) Option {
+	return func(c *Client) error {
+		if header == "" {
+			header = "Idempotency-Key"
+		}
+		if gen == nil {
+			gen = randomKey
+		}
+		c.client.Transport = &idempotencyTransport{header: header, gen: gen, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// idempotencyTransport sets the idempotency key header of mutating requests
+type idempotencyTransport struct {
+	header    string
+	gen       func() string
+	transport http.RoundTripper
+}
+
+func (t *idempotencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method == http.MethodPost || req.Method == http.MethodPatch) && req.Header.Get(t.header) == "" {
+		{{- if .Retry}}
+		// a request with an idempotency key is safe to retry
+		req = req.Clone(context.WithValue(req.Context(), retryUnsafeKey{}, true))
+		{{- else}}
+		req = req.Clone(req.Context())
+		{{- end}}
+		req.Header.Set(t.header, t.gen())
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if .RequestIDs}}
+// requestIDKey is the context key for the request id of an executing request
+type requestIDKey struct{}
+
+// RequestIDError wraps an error returned by do with the id of the failed request
+type RequestIDError struct {
+	ID  string
+	Err error
+}
+
+func (e *RequestIDError) Error() string {
+	return "request " + e.ID + ": " + e.Err.Error()
+}
+
+func (e *RequestIDError) Unwrap() error {
+	return e.Err
+}
+
+// WithRequestID sets the header, X-Request-Id if empty, of requests without one to a
+// correlation id from gen, or a random id if gen is nil, errors returned by do for the
+// request are wrapped in a RequestIDError with the id
+func WithRequestID(header string, gen func() string) Option {
+	return func(c *Client) error {
+		if header == "" {
+			header = "X-Request-Id"
+		}
+		if gen == nil {
+			gen = randomKey
+		}
+		c.client.Transport = &requestIDTransport{header: header, gen: gen, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// requestIDTransport sets the request id header and records the id for do
+type requestIDTransport struct {
+	header    string
+	gen       func() string
+	transport http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := req.Header.Get(t.header)
+	if id == "" {
+		id = t.gen()
+		req = req.Clone(req.Context())
+		req.Header.Set(t.header, id)
+	}
+	if p, ok := req.Context().Value(requestIDKey{}).(*string); ok {
+		*p = id
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if or .Idempotency .RequestIDs}}
+// randomKey returns a random 128 bit key
+func randomKey() string {
+	b := make([]byte, 16)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)
+}
+{{end}}
+
+{{if .UserAgent}}
+// WithUserAgent sets the User-Agent header of every request
+func WithUserAgent(agent string) Option {
+	return func(c *Client) error {
+		if agent == "" {
+			return errors.New("empty user agent")
+		}
+		c.client.Transport = &userAgentTransport{agent: agent, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// userAgentTransport sets the User-Agent header of requests
+type userAgentTransport struct {
+	agent     string
+	transport http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.agent)
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if .Logging}}
+// WithLogger logs the start and end of each request with the status and latency
+// at debug level
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) error {
+		if logger == nil {
+			return errors.New("nil logger")
+		}
+		c.client.Transport = &loggingTransport{logger: logger, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// loggingTransport writes structured logs for requests
+type loggingTransport struct {
+	logger    *slog.Logger
+	transport http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	ctx := req.Context()
+	logger := t.logger.With("method", req.Method, "url", req.URL.Redacted())
+	logger.DebugContext(ctx, "request")
+	start := time.Now()
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		logger.DebugContext(ctx, "request failed", "latency", time.Since(start), "error", err)
+		return res, err
+	}
+	logger.DebugContext(ctx, "response", "status", res.StatusCode, "latency", time.Since(start))
+	return res, err
+}
+{{end}}
+
+{{if .Otel}}
+// WithOpenTelemetry creates a span for each request with the method, url, and status
+// code attributes using tracers from the provider
+func WithOpenTelemetry(tp trace.TracerProvider) Option {
+	return func(c *Client) error {
+		if tp == nil {
+			return errors.New("nil tracer provider")
+		}
+		c.client.Transport = otelhttp.NewTransport(c.client.Transport, otelhttp.WithTracerProvider(tp))
+		return nil
+	}
+}
+{{end}}
+
+{{if .Uploads}}
+type uploadKey struct{}
+
+// apiTransport sends upload requests with the transport of the api client, so uploads
+// are authorized and decorated by the api client's options
+type apiTransport struct {
+	c *Client
+}
+
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.c.client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+
+// WithUploadBaseURL sets the base url of the host for uploads and downloads
+func WithUploadBaseURL(baseURL string) Option {
+	return func(c *Client) error {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("upload base url '%s' is not absolute", baseURL)
+		}
+		c.uploadBase = u
+		return nil
+	}
+}
+
+// WithUploadTransport sets the underlying http transport of the upload client in place
+// of the api client's transport, the transport must authorize the requests itself
+func WithUploadTransport(t http.RoundTripper) Option {
+	return func(c *Client) error {
+		if t == nil {
+			return errors.New("nil transport")
+		}
+		c.uploads.Transport = t
+		return nil
+	}
+}
+
+// WithUploadHTTPClient sets the underlying http client for uploads and downloads, such
+// as a client with a longer timeout than api calls. A client without a transport sends
+// uploads with the api client's transport, including its authorization, otherwise the
+// client's transport must authorize the requests itself.
+func WithUploadHTTPClient(client *http.Client) Option {
+	return func(c *Client) error {
+		if client == nil {
+			return errors.New("nil client")
+		}
+		uploads := *client
+		if uploads.Transport == nil {
+			uploads.Transport = &apiTransport{c: c}
+		}
+		c.uploads = &uploads
+		return nil
+	}
+}
+{{if .RateLimiter}}
+// WithUploadRateLimiter rate limits the client's uploads and downloads, in addition to
+// any rate limit of the api client
+func WithUploadRateLimiter(r *rate.Limiter) Option {
+	return func(c *Client) error {
+		if r == nil {
+			return errors.New("nil limiter")
+		}
+		c.uploads.Transport = &httpwares.RateLimitTransport{
+			Limiter:   r,
+			Transport: c.uploads.Transport,
+		}
+		return nil
+	}
+}
+{{end}}
+// uploadURL joins the path, and optional query, to the upload base url
+func (c *Client) uploadURL(path string) (string, error) {
+	if c.uploadBase == nil {
+		return "", errors.New("no upload base url, use With{{.Name}}UploadBaseURL")
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	u := c.uploadBase.JoinPath(ref.Path)
+	u.RawQuery = ref.RawQuery
+	return u.String(), nil
+}
+
+// upload executes the http request with the upload client and populates v with the result
+func (c *Client) upload(req *http.Request, v interface{}) error {
+	return c.do(req.WithContext(context.WithValue(req.Context(), uploadKey{}, true)), v)
+}
+{{end}}
+
+{{if or .Brotli .Compression}}
+// defaultMaxDecompressedSize is the default limit on the size of a decompressed response body
+const defaultMaxDecompressedSize = 100 << 20
+
+// DecompressionLimitError is returned when reading a decompressed response body exceeding the limit
+type DecompressionLimitError struct {
+	Limit int64
+}
+
+func (e *DecompressionLimitError) Error() string {
+	return fmt.Sprintf("decompressed response body exceeds %d bytes", e.Limit)
+}
+
+// WithMaxDecompressedSize limits the size of decompressed response bodies to protect
+// against malicious or buggy servers
+func WithMaxDecompressedSize(n int64) Option {
+	return func(c *Client) error {
+		if n <= 0 {
+			return errors.New("max decompressed size must be positive")
+		}
+		c.maxDecompressedSize = n
+		return nil
+	}
+}
+{{- if .Brotli}}
+
+// WithBrotli requests brotli encoded responses, unless the request sets its own
+// Accept-Encoding header, and transparently decompresses them.
+func WithBrotli() Option {
+	return func(c *Client) error {
+		c.client.Transport = &brotliTransport{c: c, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// brotliTransport decompresses brotli encoded response bodies
+type brotliTransport struct {
+	c         *Client
+	transport http.RoundTripper
+}
+
+func (t *brotliTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "br")
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "br") {
+		res.Body = &decompressedBody{
+			Reader: &limitReader{reader: brotli.NewReader(res.Body), limit: t.c.maxDecompressedSize},
+			body:   res.Body,
+		}
+		res.Header.Del("Content-Encoding")
+		res.Header.Del("Content-Length")
+		res.ContentLength = -1
+		res.Uncompressed = true
+	}
+	return res, nil
+}
+{{- end}}
+{{- if .Compression}}
+
+// WithCompression requests gzip or deflate encoded responses, unless the request sets its
+// own Accept-Encoding header, and transparently decompresses them. Transports layered by
+// later options see the decompressed response, and an Accept-Encoding header they set takes
+// precedence.
+func WithCompression() Option {
+	return func(c *Client) error {
+		c.client.Transport = &compressionTransport{c: c, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// compressionTransport decompresses gzip and deflate encoded response bodies
+type compressionTransport struct {
+	c         *Client
+	transport http.RoundTripper
+}
+
+func (t *compressionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if encoding := strings.ToLower(res.Header.Get("Content-Encoding")); encoding == "gzip" || encoding == "deflate" {
+		res.Body = &decompressedBody{
+			Reader: &limitReader{reader: &inflateReader{body: res.Body, encoding: encoding}, limit: t.c.maxDecompressedSize},
+			body:   res.Body,
+		}
+		res.Header.Del("Content-Encoding")
+		res.Header.Del("Content-Length")
+		res.ContentLength = -1
+		res.Uncompressed = true
+	}
+	return res, nil
+}
+
+// inflateReader decompresses the body on the first read so an empty body is not an error
+type inflateReader struct {
+	body     io.Reader
+	encoding string
+	reader   io.Reader
+}
+
+func (r *inflateReader) Read(p []byte) (int, error) {
+	if r.reader == nil {
+		var err error
+		switch r.encoding {
+		case "gzip":
+			r.reader, err = gzip.NewReader(r.body)
+		default:
+			r.reader, err = zlib.NewReader(r.body)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return r.reader.Read(p)
+}
+{{- end}}
+
+// decompressedBody reads the decompressed body and closes the underlying body
+type decompressedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b *decompressedBody) Close() error {
+	return b.body.Close()
+}
+
+// limitReader returns a *DecompressionLimitError once more than limit bytes are read
+type limitReader struct {
+	reader io.Reader
+	read   int64
+	limit  int64
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if over := r.read - r.limit; over > 0 {
+		if n -= int(over); n < 0 {
+			n = 0
+		}
+		return n, &DecompressionLimitError{Limit: r.limit}
+	}
+	return n, err
+}
+{{end}}
+
+{{if or .Cache .TTLCache}}
+// Cache stores responses by the url and credentials of their request. Responses to
+// requests authorized by a transport the cache wraps, responses marked Cache-Control
+// private without credentials in the key and responses varying on other request
+// headers are not stored, so apply the cache Options before the Options authorizing
+// requests to cache authorized responses for each credential.
+type Cache interface {
+	// Get returns the cached value for the key and true if it exists
+	Get(key string) ([]byte, bool)
+	// Set stores the value for the key
+	Set(key string, value []byte)
+	// Delete removes the key from the cache
+	Delete(key string)
+}
+{{- end}}
+{{- if .Cache}}
+
+// WithConditionalCache caches responses in the store, such as a shared or remote cache,
+// and revalidates them with conditional requests
+func WithConditionalCache(store Cache) Option {
+	return func(c *Client) error {
+		if store == nil {
+			return errors.New("nil cache")
+		}
+		c.client.Transport = &cacheTransport{cache: store, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// WithMemoryCache caches responses in memory, holding at most size entries
+func WithMemoryCache(size int) Option {
+	return func(c *Client) error {
+		if size <= 0 {
+			return errors.New("cache size must be positive")
+		}
+		c.client.Transport = &cacheTransport{cache: newMemoryCache(size), transport: c.client.Transport}
+		return nil
+	}
+}
+
+// WithCacheDir caches responses on disk in the directory, persisting them between runs
+func WithCacheDir(path string) Option {
+	return func(c *Client) error {
+		{{- if .Rollback}}
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			c.onTeardown(func() { _ = os.Remove(path) })
+		}
+		{{- end}}
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return err
+		}
+		c.client.Transport = &cacheTransport{cache: &diskCache{dir: path}, transport: c.client.Transport}
+		return nil
+	}
+}
+{{- end}}
+{{- if or .Cache .TTLCache}}
+
+// NewMemoryCache returns a Cache holding at most size entries in memory, evicting the
+// least recently used
+func NewMemoryCache(size int) (Cache, error) {
+	if size <= 0 {
+		return nil, errors.New("cache size must be positive")
+	}
+	return newMemoryCache(size), nil
+}
+
+// cacheKey returns the key of the request, the url and the hash of any credentials
+func cacheKey(req *http.Request) string {
+	key := req.URL.String()
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		key += " " + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// cacheable reports whether the response to the request may be stored under its cacheKey
+func cacheable(req *http.Request, res *http.Response) bool {
+	auth := req.Header.Get("Authorization")
+	if res.Request != nil && res.Request.Header.Get("Authorization") != auth {
+		return false
+	}
+	control := strings.ToLower(res.Header.Get("Cache-Control"))
+	if strings.Contains(control, "no-store") || (auth == "" && strings.Contains(control, "private")) {
+		return false
+	}
+	for _, vary := range res.Header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+			case "", "Accept-Encoding", "Authorization":
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// memoryCache is a least recently used Cache
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key   string
+	value []byte
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (m *memoryCache) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(elem)
+	return elem.Value.(*memoryEntry).value, true
+}
+
+func (m *memoryCache) Set(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		elem.Value.(*memoryEntry).value = value
+		m.order.MoveToFront(elem)
+		return
+	}
+	m.entries[key] = m.order.PushFront(&memoryEntry{key: key, value: value})
+	for m.order.Len() > m.size {
+		elem := m.order.Back()
+		m.order.Remove(elem)
+		delete(m.entries, elem.Value.(*memoryEntry).key)
+	}
+}
+
+func (m *memoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		m.order.Remove(elem)
+		delete(m.entries, key)
+	}
+}
+{{- end}}
+{{- if .Cache}}
+
+// diskCache is a Cache storing each entry in a file named by the hash of its key
+type diskCache struct {
+	dir string
+}
+
+func (d *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+func (d *diskCache) Get(key string) ([]byte, bool) {
+	value, err := os.ReadFile(d.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (d *diskCache) Set(key string, value []byte) {
+	_ = os.WriteFile(d.path(key), value, 0600)
+}
+
+func (d *diskCache) Delete(key string) {
+	_ = os.Remove(d.path(key))
+}
+
+// cacheTransport stores GET responses carrying an ETag or Last-Modified header and
+// replays them when the server responds to a conditional request with 304 Not Modified
+type cacheTransport struct {
+	cache     Cache
+	transport http.RoundTripper
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if req.Method != http.MethodGet {
+		return transport.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	var cached *http.Response
+	if b, ok := t.cache.Get(key); ok {
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), req)
+		if err == nil {
+			cached = res
+			req = req.Clone(req.Context())
+			if etag := res.Header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if modified := res.Header.Get("Last-Modified"); modified != "" {
+				req.Header.Set("If-Modified-Since", modified)
+			}
+		} else {
+			t.cache.Delete(key)
+		}
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cached != nil && res.StatusCode == http.StatusNotModified:
+		res.Body.Close()
+		return cached, nil
+	case res.StatusCode == http.StatusOK && (res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != "") && cacheable(req, res):
+		b, err := httputil.DumpResponse(res, true)
+		if err != nil {
+			return nil, err
+		}
+		t.cache.Set(key, b)
+	}
+	return res, nil
+}
+{{- end}}
+{{- if .TTLCache}}
+
+// WithResponseCache replays successful GET responses from the store, such as a store from
+// NewMemoryCache, until they are ttl old without making a request. Responses marked
+// Cache-Control no-store, and those Cache describes, are not cached. Use a store which
+// is not shared with WithConditionalCache.
+func WithResponseCache(ttl time.Duration, store Cache) Option {
+	return func(c *Client) error {
+		if ttl <= 0 {
+			return errors.New("cache ttl must be positive")
+		}
+		if store == nil {
+			return errors.New("nil cache")
+		}
+		c.client.Transport = &ttlCacheTransport{c: c, ttl: ttl, cache: store, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// ttlCacheTransport stores GET responses prefixed with the time they expire
+type ttlCacheTransport struct {
+	c         *Client
+	ttl       time.Duration
+	cache     Cache
+	transport http.RoundTripper
+}
+
+func (t *ttlCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if req.Method != http.MethodGet {
+		return transport.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	if b, ok := t.cache.Get(key); ok {
+		stamp, dump, _ := bytes.Cut(b, []byte("\n"))
+		expires, err := strconv.ParseInt(string(stamp), 10, 64)
+		if err == nil && t.c.now().UnixNano() < expires {
+			if res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), req); err == nil {
+				return res, nil
+			}
+		}
+		t.cache.Delete(key)
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusOK && cacheable(req, res) {
+		b, err := httputil.DumpResponse(res, true)
+		if err != nil {
+			return nil, err
+		}
+		stamp := strconv.FormatInt(t.c.now().Add(t.ttl).UnixNano(), 10)
+		t.cache.Set(key, append([]byte(stamp+"\n"), b...))
+	}
+	return res, nil
+}
+{{end}}
+
+{{if .Queue}}
+// Priority orders requests waiting in the client's queue
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose requests are queued with the priority
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// WithQueue limits the client to workers concurrent requests, dispatching waiting
+// requests by their Priority and then in arrival order. Apply this option after
+// WithRateLimiter so high priority requests jump the line under rate limiting.
+func WithQueue(workers int) Option {
+	return func(c *Client) error {
+		if workers <= 0 {
+			return errors.New("workers must be positive")
+		}
+		c.client.Transport = &queueTransport{free: workers, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// waiter is a request waiting for a worker
+type waiter struct {
+	priority Priority
+	seq      uint64
+	index    int
+	ready    chan struct{}
+}
+
+// waiters is a heap of waiting requests ordered by priority and then arrival
+type waiters []*waiter
+
+func (w waiters) Len() int {
+	return len(w)
+}
+
+func (w waiters) Less(i, j int) bool {
+	if w[i].priority != w[j].priority {
+		return w[i].priority > w[j].priority
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w waiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+
+func (w *waiters) Push(x interface{}) {
+	q := x.(*waiter)
+	q.index = len(*w)
+	*w = append(*w, q)
+}
+
+func (w *waiters) Pop() interface{} {
+	old := *w
+	q := old[len(old)-1]
+	*w = old[:len(old)-1]
+	return q
+}
+
+// queueTransport grants a bounded number of workers to requests by priority
+type queueTransport struct {
+	mu        sync.Mutex
+	free      int
+	seq       uint64
+	waiting   waiters
+	transport http.RoundTripper
+}
+
+func (t *queueTransport) acquire(ctx context.Context) error {
+	priority, _ := ctx.Value(priorityKey{}).(Priority)
+	t.mu.Lock()
+	if t.free > 0 {
+		t.free--
+		t.mu.Unlock()
+		return nil
+	}
+	w := &waiter{priority: priority, seq: t.seq, ready: make(chan struct{})}
+	t.seq++
+	heap.Push(&t.waiting, w)
+	t.mu.Unlock()
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		select {
+		case <-w.ready:
+			// the worker was granted concurrently so hand it to the next waiter
+			t.mu.Unlock()
+			t.release()
+		default:
+			heap.Remove(&t.waiting, w.index)
+			t.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+func (t *queueTransport) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.waiting.Len() > 0 {
+		close(heap.Pop(&t.waiting).(*waiter).ready)
+		return
+	}
+	t.free++
+}
+
+func (t *queueTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	defer t.release()
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+{{end}}
+
+{{if .Providers}}
+type providerKey struct{}
+
+// UseProvider returns a context whose requests are authorized with the credentials
+// of the named provider added by WithProvider
+func UseProvider(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, providerKey{}, name)
+}
+
+// WithProvider adds the oauth2 credentials of a named provider, requests select the
+// provider with UseProvider and requests without a provider are sent unchanged
+func WithProvider(name string, config oauth2.Config, token *oauth2.Token) Option {
+	return func(c *Client) error {
+		if token == nil {
+			return fmt.Errorf("provider '%s' has no token", name)
+		}
+		if _, ok := c.providers[name]; ok {
+			return fmt.Errorf("provider '%s' already exists", name)
+		}
+		if c.providers == nil {
+			c.providers = make(map[string]oauth2.TokenSource)
+			c.client.Transport = &providerTransport{providers: c.providers, transport: c.client.Transport}
+		}
+		c.providers[name] = &reauthSource{src: config.TokenSource(context.Background(), token)}
+		return nil
+	}
+}
+
+// providerTransport authorizes requests with the token of the provider in the context
+type providerTransport struct {
+	providers map[string]oauth2.TokenSource
+	transport http.RoundTripper
+}
+
+func (t *providerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	name, ok := req.Context().Value(providerKey{}).(string)
+	if !ok {
+		return transport.RoundTrip(req)
+	}
+	source, ok := t.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider '%s'", name)
+	}
+	return (&oauth2.Transport{Source: source, Base: transport}).RoundTrip(req)
+}
+{{end}}
+
+{{if .Expvar}}
+type expvarKey struct{}
+
+// WithExpvar publishes the client's request count, error count, and total seconds
+// spent waiting on rate limiters in the expvar map named prefix. Apply this option
+// after the rate limiting options so their waits are recorded.
+func WithExpvar(prefix string) Option {
+	return func(c *Client) error {
+		vars, ok := expvar.Get(prefix).(*expvar.Map)
+		if !ok {
+			if expvar.Get(prefix) != nil {
+				return fmt.Errorf("expvar '%s' is not a map", prefix)
+			}
+			vars = expvar.NewMap(prefix)
+		}
+		c.client.Transport = &expvarTransport{vars: vars, transport: c.client.Transport}
+		return nil
+	}
+}
+
+// expvarTransport counts requests and errors, making the map available to
+// the transports it wraps through the request's context
+type expvarTransport struct {
+	vars      *expvar.Map
+	transport http.RoundTripper
+}
+
+func (t *expvarTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	t.vars.Add("requests", 1)
+	req = req.WithContext(context.WithValue(req.Context(), expvarKey{}, t.vars))
+	res, err := transport.RoundTrip(req)
+	if err != nil || res.StatusCode >= http.StatusBadRequest {
+		t.vars.Add("errors", 1)
+	}
+	return res, err
+}
+{{end}}
+
+{{if .FromConfig}}
+// Config declaratively describes a Client, zero valued fields are ignored
+type Config struct {
+	{{- if .Config}}
+	ClientID     string
+	ClientSecret string
+	{{- end}}
+	{{- if .Token}}
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+	{{- end}}
+	HTTPClient   *http.Client
+	Transport    http.RoundTripper
+	{{- if .RateLimiter}}
+	RateLimiter  *rate.Limiter
+	{{- end}}
+	HTTPTracing  bool
+}
+
+// options returns the Options equivalent to the non-zero fields of the Config
+func (cfg Config) options() []Option {
+	var opts []Option
+	{{- if .Config}}
+	if cfg.ClientID != "" || cfg.ClientSecret != "" {
+		opts = append(opts, WithClientCredentials(cfg.ClientID, cfg.ClientSecret))
+	}
+	{{- end}}
+	{{- if .Token}}
+	if cfg.AccessToken != "" || cfg.RefreshToken != "" {
+		opts = append(opts, WithTokenCredentials(cfg.AccessToken, cfg.RefreshToken, cfg.Expiry))
+	}
+	{{- end}}
+	if cfg.HTTPClient != nil {
+		opts = append(opts, WithHTTPClient(cfg.HTTPClient))
+	}
+	if cfg.Transport != nil {
+		opts = append(opts, WithTransport(cfg.Transport))
+	}
+	{{- if .RateLimiter}}
+	if cfg.RateLimiter != nil {
+		opts = append(opts, WithRateLimiter(cfg.RateLimiter))
+	}
+	{{- end}}
+	if cfg.HTTPTracing {
+		opts = append(opts, WithHTTPTracing(cfg.HTTPTracing))
+	}
+	return opts
+}
+
+// NewClientFromConfig creates a new client from the Config and then applies all provided Options
+func NewClientFromConfig(cfg Config, opts ...Option) (*Client, error) {
+	return NewClient(append(cfg.options(), opts...)...)
+}
+{{end}}
+
+{{if .FromEnv}}
+// NewClientFromEnv creates a new client from the environment variables named with the
+// prefix, such as PREFIX_CLIENT_ID, and then applies all provided Options, unset or empty
+// variables are ignored
+func NewClientFromEnv(prefix string, opts ...Option) (*Client, error) {
+	env := func(name string) string {
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		return os.Getenv(name)
+	}
+	var options []Option
+	{{- if .Config}}
+	if clientID, clientSecret := env("CLIENT_ID"), env("CLIENT_SECRET"); clientID != "" || clientSecret != "" {
+		options = append(options, WithClientCredentials(clientID, clientSecret))
+	}
+	{{- end}}
+	{{- if .Token}}
+	if accessToken, refreshToken := env("ACCESS_TOKEN"), env("REFRESH_TOKEN"); accessToken != "" || refreshToken != "" {
+		options = append(options, WithTokenCredentials(accessToken, refreshToken, time.Time{}))
+	}
+	{{- end}}
+	{{- if .BaseURL}}
+	if baseURL := env("BASE_URL"); baseURL != "" {
+		options = append(options, WithBaseURL(baseURL))
+	}
+	{{- end}}
+	return NewClient(append(options, opts...)...)
+}
+{{end}}
+
+{{if .ConfigFile}}
+// ConfigFile holds the credentials read by WithConfigFile, empty fields are ignored
+type ConfigFile struct {
+	{{- if .Config}}
+	ClientID     string {{.FileTag "client_id,omitempty"}}
+	ClientSecret string {{.FileTag "client_secret,omitempty"}}
+	{{- end}}
+	{{- if .Token}}
+	AccessToken  string    {{.FileTag "access_token,omitempty"}}
+	RefreshToken string    {{.FileTag "refresh_token,omitempty"}}
+	Expiry       time.Time {{.FileTag "expiry,omitempty"}}
+	{{- end}}
+	{{- if .BaseURL}}
+	BaseURL string {{.FileTag "base_url,omitempty"}}
+	{{- end}}
+}
+
+// ReadConfigFile reads the file as yaml if its extension is .yaml or .yml and as json otherwise
+func ReadConfigFile(path string) (*ConfigFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ConfigFile{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, cfg)
+	default:
+		err = json.Unmarshal(b, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// WithConfigFile sets the client's credentials from the file, see ReadConfigFile
+func WithConfigFile(path string) Option {
+	return func(c *Client) error {
+		cfg, err := ReadConfigFile(path)
+		if err != nil {
+			return err
+		}
+		var opts []Option
+		{{- if .Config}}
+		if cfg.ClientID != "" || cfg.ClientSecret != "" {
+			opts = append(opts, WithClientCredentials(cfg.ClientID, cfg.ClientSecret))
+		}
+		{{- end}}
+		{{- if .Token}}
+		if cfg.AccessToken != "" || cfg.RefreshToken != "" {
+			opts = append(opts, WithTokenCredentials(cfg.AccessToken, cfg.RefreshToken, cfg.Expiry))
+		}
+		{{- end}}
+		{{- if .BaseURL}}
+		if cfg.BaseURL != "" {
+			opts = append(opts, WithBaseURL(cfg.BaseURL))
+		}
+		{{- end}}
+		for _, opt := range opts {
+			if err := opt(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+{{end}}
+
+{{if .Builder}}
+// ClientBuilder provides a chainable alternative to Options for creating a Client
+type ClientBuilder struct {
+	opts []Option
+}
+
+// NewClientBuilder creates a new, empty ClientBuilder
+func NewClientBuilder() *ClientBuilder {
+	return &ClientBuilder{}
+}
+
+// With adds the Options to the builder
+func (b *ClientBuilder) With(opts ...Option) *ClientBuilder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+{{if .Config}}
+// Config sets the underlying oauth2.Config.
+func (b *ClientBuilder) Config(config oauth2.Config) *ClientBuilder {
+	return b.With(WithConfig(config))
+}
+
+// ClientCredentials provides the client api credentials for the application.
+func (b *ClientBuilder) ClientCredentials(clientID, clientSecret string) *ClientBuilder {
+	return b.With(WithClientCredentials(clientID, clientSecret))
+}
+{{if or .Endpoint .EndpointFunc}}
+// AutoRefresh refreshes access tokens automatically.
+func (b *ClientBuilder) AutoRefresh(ctx context.Context) *ClientBuilder {
+	return b.With(WithAutoRefresh(ctx))
+}
+{{end}}
+{{- end}}
+{{if .Token}}
+// Token sets the underlying oauth2.Token.
+func (b *ClientBuilder) Token(token *oauth2.Token) *ClientBuilder {
+	return b.With(WithToken(token))
+}
+
+// TokenCredentials provides the tokens for an authenticated user.
+func (b *ClientBuilder) TokenCredentials(accessToken, refreshToken string, expiry time.Time) *ClientBuilder {
+	return b.With(WithTokenCredentials(accessToken, refreshToken, expiry))
+}
+
+// TokenSource authorizes requests with tokens from the source.
+func (b *ClientBuilder) TokenSource(src oauth2.TokenSource) *ClientBuilder {
+	return b.With(WithTokenSource(src))
+}
+{{end}}
+{{if .RateLimiter}}
+// RateLimiter rate limits the client's api calls
+func (b *ClientBuilder) RateLimiter(r *rate.Limiter) *ClientBuilder {
+	return b.With(WithRateLimiter(r))
+}
+{{end}}
+// HTTPTracing enables tracing http calls.
+func (b *ClientBuilder) HTTPTracing(debug bool) *ClientBuilder {
+	return b.With(WithHTTPTracing(debug))
+}
+
+// Transport sets the underlying http client transport.
+func (b *ClientBuilder) Transport(t http.RoundTripper) *ClientBuilder {
+	return b.With(WithTransport(t))
+}
+
+// HTTPClient sets the underlying http client.
+func (b *ClientBuilder) HTTPClient(client *http.Client) *ClientBuilder {
+	return b.With(WithHTTPClient(client))
+}
+
+// Build creates a new Client, applying the builder's Options in the order they were set
+func (b *ClientBuilder) Build() (*Client, error) {
+	return NewClient(b.opts...)
+}
+{{end}}
+
+{{if or .RequestDump .Curl}}
+// RequestDump is a sanitized record of an http request
+type RequestDump struct {
+	Method string
+	URL    string
+	Header http.Header
+}
+
+// sensitive returns true if the header or query parameter name likely holds a secret
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"authorization", "cookie", "token", "secret", "password", "key", "signature"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpRequest returns a copy of the request's method, url, and headers with secrets masked
+func dumpRequest(req *http.Request) RequestDump {
+	u := *req.URL
+	query := u.Query()
+	for key := range query {
+		if sensitive(key) {
+			query.Set(key, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+	header := req.Header.Clone()
+	for key := range header {
+		if sensitive(key) {
+			header.Set(key, "REDACTED")
+		}
+	}
+	return RequestDump{
+		Method: req.Method,
+		URL:    u.Redacted(),
+		Header: header,
+	}
+}
+{{- end}}
+{{if .Curl}}
+// Curl returns a curl command reproducing the request, without the request body
+func (d RequestDump) Curl() string {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+	}
+	keys := make([]string, 0, len(d.Header))
+	for key := range d.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	cmd := []string{"curl", "-X", d.Method}
+	for _, key := range keys {
+		for _, value := range d.Header[key] {
+			cmd = append(cmd, "-H", quote(key+": "+value))
+		}
+	}
+	return strings.Join(append(cmd, quote(d.URL)), " ")
+}
+
+// WithCurlOnError writes a curl command reproducing each failed request to w, with
+// secrets masked. Writes are not synchronized so w must be safe for concurrent use.
+func WithCurlOnError(w io.Writer) Option {
+	return func(c *Client) error {
+		c.curl = w
+		return nil
+	}
+}
+{{- end}}
+{{if .RequestDump}}
+// RequestError wraps an error returned by the client with a dump of the failed request
+type RequestError struct {
+	Request RequestDump
+	Err     error
+}
+
+func (e *RequestError) Error() string {
+	return e.Request.Method + " " + e.Request.URL + ": " + e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+{{end}}
+
+{{if .HTTPError}}
+{{- if .CaptureBody}}
+// maxErrorBody is the number of bytes of an error response body kept by HTTPError
+const maxErrorBody = 4 << 10
+{{end}}
+// HTTPError records the http call which resulted in a fault
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	RequestID  string
+	{{- if .CaptureBody}}
+	// Body is the raw response body truncated to maxErrorBody bytes
+	Body []byte
+	{{- end}}
+	Err error
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d: %s", e.Method, e.URL, e.StatusCode, e.Err)
+	if e.RequestID != "" {
+		msg += " (request id: " + e.RequestID + ")"
+	}
+	{{- if .CaptureBody}}
+	if len(e.Body) > 0 {
+		msg += fmt.Sprintf(" (body: %q)", e.Body)
+	}
+	{{- end}}
+	return msg
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+{{end}}
+
+{{if .Shutdown}}
+// ErrShutdown is returned by do after the client has been shut down
+var ErrShutdown = errors.New("client is shut down")
+
+// inflight tracks the requests executing in do
+type inflight struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// start tracks a new request unless the client has been shut down
+func (f *inflight) start() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.wg.Add(1)
+	return true
+}
+
+// close stops tracking new requests and returns a channel closed when all
+// in-flight requests have finished
+func (f *inflight) close() <-chan struct{} {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// Shutdown stops accepting new requests, waits for in-flight requests to finish or
+// the context to expire, and then closes idle connections.
+func (c *Client) Shutdown(ctx context.Context) error {
+	select {
+	case <-c.inflight.close():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.client.CloseIdleConnections()
+	{{- if .Uploads}}
+	c.uploads.CloseIdleConnections()
+	{{- end}}
+	return nil
+}
+{{end}}
+
+{{if .Stats}}
+// Stat describes a request executed by do
+type Stat struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Attempts   int
+	Latency    time.Duration
+	Err        error
+}
+
+// statKey is the context key for the Stat of an executing request
+type statKey struct{}
+
+// WithStats calls fn with the Stat of every request executed by the client
+func WithStats(fn func(Stat)) Option {
+	return func(c *Client) error {
+		c.stats = fn
+		return nil
+	}
+}
+
+// urlTemplate returns the url path with numeric elements replaced by {id}
+func urlTemplate(req *http.Request) string {
+	elems := strings.Split(req.URL.Path, "/")
+	for i, elem := range elems {
+		if _, err := strconv.ParseUint(elem, 10, 64); err == nil {
+			elems[i] = "{id}"
+		}
+	}
+	return strings.Join(elems, "/")
+}
+{{end}}
+
+{{if .Health}}
+// healthWindow is the number of most recent requests used to compute rates
+const healthWindow = 100
+
+// Health summarizes the outcome of recent requests for a class of endpoints
+type Health struct {
+	Requests    int
+	Errors      int
+	SuccessRate float64
+	ErrorRate   float64
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// outcomes is a ring buffer of recent request failures
+type outcomes struct {
+	failures    []bool
+	next        int
+	lastError   error
+	lastErrorAt time.Time
+	{{- if .Breaker}}
+	// consecutive failures of the upstream and when the last failed or a trial was allowed
+	consecutive int
+	trippedAt   time.Time
+	{{- end}}
+}
+
+type health struct {
+	mu      sync.Mutex
+	classes map[string]*outcomes
+}
+
+func newHealth() *health {
+	return &health{classes: make(map[string]*outcomes)}
+}
+
+// endpointClass groups requests by method and the first element of the url path
+func endpointClass(req *http.Request) string {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[:i]
+	}
+	return req.Method + " /" + path
+}
+
+// record the outcome of the request, requests canceled by the caller
+{{- if .Breaker}} or failing fast{{end}} are not counted
+func (h *health) record(req *http.Request, err error, now time.Time) {
+	if errors.Is(err, context.Canceled){{if .Breaker}} || errors.Is(err, ErrCircuitOpen){{end}} {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	class := endpointClass(req)
+	o, ok := h.classes[class]
+	if !ok {
+		o = &outcomes{}
+		h.classes[class] = o
+	}
+	if len(o.failures) < healthWindow {
+		o.failures = append(o.failures, err != nil)
+	} else {
+		o.failures[o.next] = err != nil
+	}
+	o.next = (o.next + 1) % healthWindow
+	if err != nil {
+		o.lastError = err
+		o.lastErrorAt = now
+	}
+	{{- if .Breaker}}
+	if upstream(err) {
+		o.consecutive++
+		o.trippedAt = now
+	} else {
+		o.consecutive = 0
+	}
+	{{- end}}
+}
+{{- if .Breaker}}
+
+// upstream returns true if the error is a failure of the upstream rather than of the
+// request, a transport error or a server error status
+func upstream(err error) bool {
+	var fault *{{.Fault}}
+	if errors.As(err, &fault) {
+		return fault.Code >= http.StatusInternalServerError
+	}
+	return err != nil
+}
+
+// allow returns true if a request of the class may be sent, the circuit opens after
+// threshold consecutive failures of the upstream and allows a trial request each cooldown
+func (h *health) allow(class string, threshold int, cooldown time.Duration, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o, ok := h.classes[class]
+	if !ok || o.consecutive < threshold {
+		return true
+	}
+	if now.Sub(o.trippedAt) < cooldown {
+		return false
+	}
+	o.trippedAt = now
+	return true
+}
+{{- end}}
+
+// Health returns the rolling success and error rates for each endpoint class
+func (c *Client) Health() map[string]Health {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+	res := make(map[string]Health, len(c.health.classes))
+	for class, o := range c.health.classes {
+		h := Health{
+			Requests:    len(o.failures),
+			LastError:   o.lastError,
+			LastErrorAt: o.lastErrorAt,
+		}
+		for _, failed := range o.failures {
+			if failed {
+				h.Errors++
+			}
+		}
+		if h.Requests > 0 {
+			h.ErrorRate = float64(h.Errors) / float64(h.Requests)
+			h.SuccessRate = 1 - h.ErrorRate
+		}
+		res[class] = h
+	}
+	return res
+}
+{{end}}
+
+{{if .Ping}}
+// Ping returns an error if the service is unavailable, suitable for readiness probes,
+// the context bounds the time spent waiting on the service
+func (c *Client) Ping(ctx context.Context) error {
+	{{- if .BaseURL}}
+	req, err := c.newAPIRequest(ctx, http.MethodGet, {{printf "%q" .Ping}})
+	{{- else}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, {{printf "%q" .Ping}}, nil)
+	{{- end}}
+	if err != nil {
+		return err
+	}
+	return c.do(req, nil)
+}
+{{end}}
+
+{{if .Batch}}
+// BatchRequest pairs a prepared request with the value populated from its response
+type BatchRequest struct {
+	Request *http.Request
+	Value   interface{}
+}
+
+// Batch executes the requests through do with at most concurrency in flight and
+// returns the error of each request in order. Requests not started before ctx is
+// done fail with the context's error.
+func (c *Client) Batch(ctx context.Context, concurrency int, reqs []BatchRequest) []error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	errs := make([]error, len(reqs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range reqs {
+		select {
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = c.do(reqs[i].Request, reqs[i].Value)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+{{end}}
+
+{{if .Do}}
+{{- if .NoContent}}
+// ErrNoContent is returned by do when a value was expected but the response had no content
+var ErrNoContent = errors.New("no content")
+{{end}}
+{{- if .ErrorMap}}
+// errors returned by do, wrapping the fault, for responses with the status code
+var (
+{{- range .ErrorMap}}
+	{{.Name}} = errors.New({{printf "%q" .Message}})
+{{- end}}
+)
+
+// statusErrors maps status codes to the errors returned by do
+var statusErrors = map[int]error{
+{{- range .ErrorMap}}
+	{{.Code}}: {{.Name}},
+{{- end}}
+}
+{{end}}
+{{if .GenFault}}
+// {{.Fault}} is the error decoded by do from error responses
+type {{.Fault}} struct {
+	Code    int    {{.Tag "code"}}
+	Message string {{.Tag "message"}}
+	Details string {{.Tag "details,omitempty"}}
+}
+
+func (f *{{.Fault}}) Error() string {
+	if f.Details != "" {
+		return fmt.Sprintf("%d: %s: %s", f.Code, f.Message, f.Details)
+	}
+	return fmt.Sprintf("%d: %s", f.Code, f.Message)
+}
+
+// Is reports whether the target is a *{{.Fault}} with the same code, a target without a
+// code matches any fault
+func (f *{{.Fault}}) Is(target error) bool {
+	t, ok := target.(*{{.Fault}})
+	if !ok {
+		return false
+	}
+	return t.Code == 0 || t.Code == f.Code
+}
+{{end}}
+{{if .NDJSON}}
+// decodeLines calls fn with each newline delimited json object of the stream as it
+// arrives, the objects are json.RawMessage values for the callback to unmarshal
+func decodeLines(r io.Reader, fn func(interface{}) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg json.RawMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+}
+{{end}}
+{{if .Custom}}
+// Decoder decodes response bodies into values
+type Decoder interface {
+	Decode(r io.Reader, v interface{}) error
+}
+
+// DecoderFunc adapts a function to a Decoder
+type DecoderFunc func(r io.Reader, v interface{}) error
+
+// Decode calls f(r, v)
+func (f DecoderFunc) Decode(r io.Reader, v interface{}) error {
+	return f(r, v)
+}
+
+// decodeJSON is the default decoder
+func decodeJSON(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// WithDecoder decodes response bodies, including faults, with the decoder in place of json
+func WithDecoder(d Decoder) Option {
+	return func(c *Client) error {
+		if d == nil {
+			return errors.New("nil decoder")
+		}
+		c.decoder = d
+		return nil
+	}
+}
+{{end}}
+{{if .Auto}}
+// decodeAuto decodes the response body with xml when the content type is xml and with
+// json otherwise, since some apis respond with xml errors to requests for json
+func decodeAuto(res *http.Response, v interface{}) error {
+	mediatype, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediatype == "application/xml" || mediatype == "text/xml" || strings.HasSuffix(mediatype, "+xml") {
+		return xml.NewDecoder(res.Body).Decode(v)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+{{end}}
+{{if .DoResponse}}
+type responseKey struct{}
+
+// doResponse executes the http request like do and returns the response for access to
+// its headers, the body of the response has been read and closed
+func (c *Client) doResponse(req *http.Request, v interface{}) (*http.Response, error) {
+	var res *http.Response
+	req = req.WithContext(context.WithValue(req.Context(), responseKey{}, &res))
+	err := c.do(req, v)
+	return res, err
+}
+{{end}}
+{{if .Hooks}}
+// WithRequestHook calls the hook with each request before it is sent, the hook may modify
+// the request and an error aborts it
+func WithRequestHook(hook func(*http.Request) error) Option {
+	return func(c *Client) error {
+		if hook == nil {
+			return errors.New("nil request hook")
+		}
+		c.requestHooks = append(c.requestHooks, hook)
+		return nil
+	}
+}
+
+// WithResponseHook calls the hook with each response before its body is decoded, an error
+// is returned in place of decoding the response
+func WithResponseHook(hook func(*http.Response) error) Option {
+	return func(c *Client) error {
+		if hook == nil {
+			return errors.New("nil response hook")
+		}
+		c.responseHooks = append(c.responseHooks, hook)
+		return nil
+	}
+}
+{{end}}
+{{- if .RequestOpts}}
+// RequestOption configures a single request executed by do
+type RequestOption func(*requestOptions) error
+
+type requestOptions struct {
+	header  http.Header
+	query   url.Values
+	timeout time.Duration
+}
+
+// RequestHeader sets the header of the request
+func RequestHeader(key, value string) RequestOption {
+	return func(o *requestOptions) error {
+		o.header.Set(key, value)
+		return nil
+	}
+}
+
+// RequestQuery sets the query parameter of the request
+func RequestQuery(key, value string) RequestOption {
+	return func(o *requestOptions) error {
+		o.query.Set(key, value)
+		return nil
+	}
+}
+
+// RequestTimeout limits the time of the request, including reading the response, it
+// does not apply to streamed responses whose body is read after do returns
+func RequestTimeout(timeout time.Duration) RequestOption {
+	return func(o *requestOptions) error {
+		if timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// withRequestOptions returns a copy of the request with the options applied and the func
+// releasing the resources of its timeout
+func withRequestOptions(req *http.Request, opts []RequestOption) (*http.Request, context.CancelFunc, error) {
+	o := &requestOptions{header: make(http.Header), query: make(url.Values)}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, nil, err
+		}
+	}
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if o.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+	}
+	req = req.Clone(ctx)
+	for key, values := range o.header {
+		req.Header[key] = values
+	}
+	if len(o.query) > 0 {
+		query := req.URL.Query()
+		for key, values := range o.query {
+			query[key] = values
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	return req, cancel, nil
+}
+{{end}}
+{{- if or .RequestDump .Health .Shutdown .Stats .Curl .RequestIDs .RequestOpts}}
+// do executes the http request and populates v with the result.
+{{- if .RequestDump}}
+// Errors are returned as a *RequestError holding a sanitized dump of the request.
+{{- end}}
+{{- if .RequestOpts}}
+func (c *Client) do(req *http.Request, v interface{}, opts ...RequestOption) error {
+	if len(opts) > 0 {
+		var cancel context.CancelFunc
+		var err error
+		req, cancel, err = withRequestOptions(req, opts)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+	}
+{{- else}}
+func (c *Client) do(req *http.Request, v interface{}) error {
+{{- end}}
+	{{- if .Shutdown}}
+	if !c.inflight.start() {
+		return ErrShutdown
+	}
+	defer c.inflight.wg.Done()
+	{{- end}}
+	{{- if .Stats}}
+	var stat *Stat
+	if c.stats != nil {
+		stat = &Stat{Method: req.Method, URL: urlTemplate(req), Attempts: 1}
+		req = req.WithContext(context.WithValue(req.Context(), statKey{}, stat))
+	}
+	start := c.now()
+	{{- end}}
+	{{- if .RequestIDs}}
+	var id string
+	req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, &id))
+	{{- end}}
+	err := c.send(req, v)
+	{{- if .Stats}}
+	if stat != nil {
+		stat.Latency = c.now().Sub(start)
+		stat.Err = err
+		c.stats(*stat)
+	}
+	{{- end}}
+	{{- if .Health}}
+	c.health.record(req, err, c.now())
+	{{- end}}
+	{{- if .Curl}}
+	if err != nil && c.curl != nil {
+		fmt.Fprintln(c.curl, dumpRequest(req).Curl())
+	}
+	{{- end}}
+	{{- if .RequestIDs}}
+	if err != nil && id != "" {
+		err = &RequestIDError{ID: id, Err: err}
+	}
+	{{- end}}
+	{{- if .RequestDump}}
+	if err != nil {
+		return &RequestError{Request: dumpRequest(req), Err: err}
+	}
+	{{- end}}
+	return err
+}
+
+// send executes the http request and populates v with the result.
+func (c *Client) send(req *http.Request, v interface{}) error {
+{{- else}}
+// do executes the http request and populates v with the result.
+func (c *Client) do(req *http.Request, v interface{}) error {
+{{- end}}
+	ctx := req.Context()
+	{{- if .Hooks}}
+	for _, hook := range c.requestHooks {
+		if err := hook(req); err != nil {
+			return err
+		}
+	}
+	{{- end}}
+	{{- if .Uploads}}
+	client := c.client
+	if upload, _ := ctx.Value(uploadKey{}).(bool); upload {
+		client = c.uploads
+	}
+	res, err := client.Do(req)
+	{{- else}}
+	res, err := c.client.Do(req)
+	{{- end}}
+	if err != nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		default:
+		}
+		{{- if .WrapErrors}}
+		return fmt.Errorf("do %s %s: %w", req.Method, req.URL.Redacted(), err)
+		{{- else}}
+		return err
+		{{- end}}
+	}
+	{{- if .DoResponse}}
+	if r, ok := ctx.Value(responseKey{}).(**http.Response); ok {
+		*r = res
+	}
+	{{- end}}
+	{{- if .Hooks}}
+	for _, hook := range c.responseHooks {
+		if err := hook(res); err != nil {
+			res.Body.Close()
+			return err
+		}
+	}
+	{{- end}}
+	{{- if or .Stream .SSE .Download}}
+	stream, _ := v.(**http.Response)
+	if stream == nil || res.StatusCode >= http.StatusBadRequest {
+		defer res.Body.Close()
+	}
+	{{- else}}
+	defer res.Body.Close()
+	{{- end}}
+	{{- if .Stats}}
+	if stat, ok := ctx.Value(statKey{}).(*Stat); ok {
+		stat.StatusCode = res.StatusCode
+	}
+	{{- end}}
+
+	httpError := res.StatusCode >= http.StatusBadRequest
+	{{- if .CaptureBody}}
+
+	// keep a copy of the start of an error body while it is decoded
+	var body []byte
+	if httpError {
+		body, _ = io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+		res.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), res.Body))
+	}
+	{{- end}}
+	{{- if or .Stream .SSE .Download}}
+
+	// the caller reads and closes the body of a successful streaming response
+	if stream != nil && !httpError {
+		*stream = res
+		return nil
+	}
+	{{- end}}
+
+	// 204 No Content and HEAD responses never have a body to decode
+	if !httpError && (res.StatusCode == http.StatusNoContent || req.Method == http.MethodHead) {
+		{{- if .NoContent}}
+		if v != nil {
+			return ErrNoContent
+		}
+		{{- end}}
+		return nil
+	}
+
+	var obj interface{}
+	if httpError {
+		obj = &{{.Fault}}{}
+	} else {
+		obj = v
+	}
+
+	if obj != nil {
+		{{- if .NDJSON}}
+		// a callback receives the newline delimited objects of a stream as they arrive
+		if fn, ok := obj.(func(interface{}) error); ok {
+			{{- if .WrapErrors}}
+			if err := decodeLines(res.Body, fn); err != nil {
+				return fmt.Errorf("decode %s %s: %w", req.Method, req.URL.Redacted(), err)
+			}
+			return nil
+			{{- else}}
+			return decodeLines(res.Body, fn)
+			{{- end}}
+		}
+		{{- end}}
+		{{- if .Custom}}
+		err := c.decoder.Decode(res.Body, obj)
+		{{- else if .Auto}}
+		err := decodeAuto(res, obj)
+		{{- else}}
+		err := {{.Decoder}}.NewDecoder(res.Body).Decode(obj)
+		{{- end}}
+		if err == io.EOF {
+			err = nil // ignore EOF errors caused by empty response body
+		}
+		if httpError {
+			switch q := obj.(type) {
+			case *{{.Fault}}:
+				if q.Code == 0 {
+					q.Code = res.StatusCode
+				}
+				if q.Message == "" {
+					q.Message = http.StatusText(res.StatusCode)
+				}
+				err = q
+			case error:
+				err = q
+			default:
+				err = q.(error)
+			}
+			{{- if .ErrorMap}}
+			if sentinel, ok := statusErrors[res.StatusCode]; ok {
+				err = fmt.Errorf("%w: %w", sentinel, err)
+			}
+			{{- end}}
+			{{- if .HTTPError}}
+			return &HTTPError{
+				Method:     req.Method,
+				URL:        req.URL.Redacted(),
+				StatusCode: res.StatusCode,
+				RequestID:  res.Header.Get({{printf "%q" .RequestID}}),
+				{{- if .CaptureBody}}
+				Body: body,
+				{{- end}}
+				Err: err,
+			}
+			{{- else}}
+			return err
+			{{- end}}
+		}
+		{{- if or .SoftErrors .WrapErrors}}
+		if err != nil {
+			{{- if .WrapErrors}}
+			return fmt.Errorf("decode %s %s: %w", req.Method, req.URL.Redacted(), err)
+			{{- else}}
+			return err
+			{{- end}}
+		}
+		{{- if .SoftErrors}}
+		// softError is provided by the package to detect error envelopes in successful responses
+		return softError(obj)
+		{{- else}}
+		return nil
+		{{- end}}
+		{{- else}}
+		return err
+		{{- end}}
+	}
+
+	return nil
+}
+{{if or .Stream .SSE}}
+// doStream executes the http request and returns the body of a successful response for
+// the caller to read and close rather than decoding it, error responses are returned as by do
+func (c *Client) doStream(req *http.Request) (io.ReadCloser, error) {
+	var res *http.Response
+	if err := c.do(req, &res); err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+{{end}}
+{{- if .Download}}
+// download streams the body of the response to w, calling progress, if not nil, with
+// the bytes written and the Content-Length, or -1 if unknown, as the body is copied
+func (c *Client) download(ctx context.Context, req *http.Request, w io.Writer, progress func(written, total int64)) error {
+	var res *http.Response
+	if err := c.{{if .Uploads}}upload{{else}}do{{end}}(req.WithContext(ctx), &res); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if progress != nil {
+		w = &progressWriter{w: w, total: res.ContentLength, progress: progress}
+	}
+	_, err := io.Copy(w, res.Body)
+	return err
+}
+
+// progressWriter reports the bytes written to the progress func
+type progressWriter struct {
+	w        io.Writer
+	written  int64
+	total    int64
+	progress func(written, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.progress(p.written, p.total)
+	return n, err
+}
+{{end}}
+{{- if .SSE}}
+// defaultEventRetry is the reconnection delay until the event stream sets one
+const defaultEventRetry = 3 * time.Second
+
+// Event is a server-sent event
+type Event struct {
+	// ID is the last event id of the stream
+	ID string
+	// Event is the type of the event, "message" unless the stream names one
+	Event string
+	// Data is the data of the event with the lines joined by newlines
+	Data string
+}
+
+// Events streams the server-sent events of the request, reconnecting with the
+// Last-Event-ID header when the connection ends. The channel is closed when ctx
+// is done or the server responds to a reconnection with an error.
+func (c *Client) Events(ctx context.Context, req *http.Request) (<-chan Event, error) {
+	body, err := c.openEvents(ctx, req, "")
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		id, retry := "", defaultEventRetry
+		for {
+			if body != nil {
+				id, retry = readEvents(ctx, body, events, id, retry)
+				body.Close()
+			}
+			if c.sleep(ctx, retry) != nil {
+				return
+			}
+			body, err = c.openEvents(ctx, req, id)
+			var fault *{{.Fault}}
+			if errors.As(err, &fault) {
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// openEvents requests the event stream resuming after the last event id
+func (c *Client) openEvents(ctx context.Context, req *http.Request, id string) (io.ReadCloser, error) {
+	req = req.Clone(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if id != "" {
+		req.Header.Set("Last-Event-ID", id)
+	}
+	return c.doStream(req)
+}
+
+// readEvents sends the events of the stream until it ends and returns the last event
+// id and the reconnection delay for resuming the stream
+func readEvents(ctx context.Context, r io.Reader, events chan<- Event, id string, retry time.Duration) (string, time.Duration) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	var event Event
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// a blank line dispatches the event
+			if data != nil {
+				event.ID, event.Data = id, strings.Join(data, "\n")
+				if event.Event == "" {
+					event.Event = "message"
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return id, retry
+				}
+			}
+			event, data = Event{}, nil
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "":
+			// a line beginning with a colon is a comment
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				id = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	return id, retry
+}
+{{end}}
+{{- if .Multipart}}
+// File is a file of a multipart upload
+type File struct {
+	// Field is the name of the form field
+	Field string
+	// Name is the name of the file
+	Name string
+	// Reader is the content of the file
+	Reader io.Reader
+}
+
+// uploadMultipart posts the fields and files as a multipart form to the {{if .Uploads}}path joined to the upload base url{{else if .BaseURL}}path joined to the base url{{else}}url{{end}},
+// the body is streamed so files are not buffered in memory
+func (c *Client) uploadMultipart(ctx context.Context, {{if or .Uploads .BaseURL}}path{{else}}rawURL{{end}} string, fields map[string]string, files ...File) error {
+	{{- if or .Uploads .BaseURL}}
+	u, err := c.{{if .Uploads}}uploadURL{{else}}apiURL{{end}}(path)
+	if err != nil {
+		return err
+	}
+	{{- end}}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mw := multipart.NewWriter(pw)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, {{if or .Uploads .BaseURL}}u{{else}}rawURL{{end}}, pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	go func() {
+		pw.CloseWithError(writeMultipart(mw, fields, files))
+	}()
+	{{- if .Uploads}}
+	return c.upload(req, nil)
+	{{- else}}
+	return c.do(req, nil)
+	{{- end}}
+}
+
+// writeMultipart writes the fields, in sorted order, and then the files to the form
+func writeMultipart(mw *multipart.Writer, fields map[string]string, files []File) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := mw.WriteField(name, fields[name]); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		w, err := mw.CreateFormFile(file.Field, file.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, file.Reader); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+{{end}}
+{{- if .Generics}}
+// do executes the http request and returns the result decoded as a T
+func do[T any](c *Client, req *http.Request) (T, error) {
+	var v T
+	if err := c.do(req, &v); err != nil {
+		var zero T
+		return zero, err
+	}
+	return v, nil
+}
+
+// get requests the {{if .BaseURL}}path joined to the base url{{else}}url{{end}} and returns the result decoded as a T
+func get[T any](ctx context.Context, c *Client, {{if .BaseURL}}path{{else}}rawURL{{end}} string) (T, error) {
+	{{- if .BaseURL}}
+	req, err := c.newAPIRequest(ctx, http.MethodGet, path)
+	{{- else}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	{{- end}}
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return do[T](c, req)
+}
+{{end}}
+{{if .Fluent}}
+// Request builds a request fluently and executes it with the client
+type Request struct {
+	c      *Client
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	{{- if .Encoder}}
+	body   interface{}
+	{{- else}}
+	body   io.Reader
+	{{- end}}
+}
+
+// NewRequest returns a builder for a GET request
+func (c *Client) NewRequest() *Request {
+	return &Request{c: c, method: http.MethodGet, query: make(url.Values), header: make(http.Header)}
+}
+
+// Method sets the method of the request
+func (r *Request) Method(method string) *Request {
+	r.method = method
+	return r
+}
+
+// Path sets the {{if .BaseURL}}path of the request joined to the base url{{else}}url of the request{{end}}
+func (r *Request) Path(path string) *Request {
+	r.path = path
+	return r
+}
+
+// Query adds the value to the query parameter
+func (r *Request) Query(key, value string) *Request {
+	r.query.Add(key, value)
+	return r
+}
+
+// Header adds the value to the header
+func (r *Request) Header(key, value string) *Request {
+	r.header.Add(key, value)
+	return r
+}
+
+// Body sets the body of the request{{if .Encoder}}, encoded as {{.Encoder}}{{end}}
+func (r *Request) Body(body {{if .Encoder}}interface{}{{else}}io.Reader{{end}}) *Request {
+	r.body = body
+	return r
+}
+
+// Do executes the request and populates v with the result
+func (r *Request) Do(ctx context.Context, v interface{}) error {
+	req, err := r.build(ctx)
+	if err != nil {
+		return err
+	}
+	return r.c.do(req, v)
+}
+
+func (r *Request) build(ctx context.Context) (*http.Request, error) {
+	{{- if .Encoder}}
+	req, err := r.c.newRequest(ctx, r.method, r.path, r.body)
+	{{- else if .BaseURL}}
+	u, err := r.c.apiURL(r.path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u, r.body)
+	{{- else}}
+	req, err := http.NewRequestWithContext(ctx, r.method, r.path, r.body)
+	{{- end}}
+	if err != nil {
+		return nil, err
+	}
+	if len(r.query) > 0 {
+		q := req.URL.Query()
+		for key, values := range r.query {
+			q[key] = append(q[key], values...)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	for key, values := range r.header {
+		req.Header[key] = append(req.Header[key], values...)
+	}
+	return req, nil
+}
+{{end}}
+{{end}}`
+
+	qbench = `// Code generated by "genwith {{.Flags}}"; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// handlerTransport serves requests in memory with the handler
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, req)
+	return w.Result(), nil
+}
+
+type benchItem struct {
+	ID   int    ` + "`json:\"id\" xml:\"id\"`" + `
+	Name string ` + "`json:\"name\" xml:\"name\"`" + `
+}
+
+type benchPayload struct {
+	Items []benchItem ` + "`json:\"items\" xml:\"item\"`" + `
+}
+
+func benchBody(b *testing.B, n int) []byte {
+	b.Helper()
+	payload := benchPayload{Items: make([]benchItem, n)}
+	for i := range payload.Items {
+		payload.Items[i] = benchItem{ID: i, Name: "item"}
+	}
+	body, err := {{.Decoder}}.Marshal(payload)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return body
+}
+
+func benchmarkDo(b *testing.B, status int, body []byte) {
+	b.Helper()
+	c, err := NewClient(WithTransport(&handlerTransport{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(status)
+			_, _ = w.Write(body)
+		}),
+	}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = c.do(req, &benchPayload{})
+		if (status < http.StatusBadRequest) != (err == nil) {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDoSmall(b *testing.B) {
+	benchmarkDo(b, http.StatusOK, benchBody(b, 1))
+}
+
+func BenchmarkDoLarge(b *testing.B) {
+	benchmarkDo(b, http.StatusOK, benchBody(b, 10000))
+}
+
+func BenchmarkDoError(b *testing.B) {
+	benchmarkDo(b, http.StatusBadRequest, nil)
+}
+`
+
+	qdoc = `// Code generated by "genwith {{.Flags}}"; DO NOT EDIT.
+
+/*
+Package {{.Package}} provides a client configured with functional options.
+
+The client was generated by genwith with the flags:
+
+	{{.Flags}}
+
+# Options
+
+{{if .Client}}A client is created by NewClient from a list of Option values:{{else}}The client is configured by Option values:{{end}}
+
+  - WithHTTPClient and WithTransport replace the underlying http client and transport
+  - WithHTTPTracing logs requests and responses
+{{- if .Custom}}
+  - WithDecoder decodes response bodies with a Decoder in place of json
+{{- end}}
+{{- if .Config}}
+  - WithConfig and WithClientCredentials configure the oauth2 application
+{{- end}}
+{{- if or .Endpoint .EndpointFunc}}
+  - WithAutoRefresh refreshes the oauth2 token as it expires
+{{- end}}
+{{- if .TwoLegged}}
+  - WithClientCredentialsFlow authenticates the client with the oauth2 client credentials flow
+{{- end}}
+{{- if .Token}}
+  - WithToken and WithTokenCredentials set the oauth2 token
+  - WithTokenSource authorizes requests with tokens from a source
+{{- end}}
+{{- if .RefreshHook}}
+  - WithTokenRefreshHook is called with refreshed tokens
+{{- end}}
+{{- if .Leeway}}
+  - WithTokenExpiryLeeway refreshes tokens before they expire
+{{- end}}
+{{- if .TokenStore}}
+  - WithTokenStore loads the token from and saves refreshed tokens to a TokenStore
+{{- end}}
+{{- if .ConfigFile}}
+  - WithConfigFile reads credentials from a json or yaml file
+{{- end}}
+{{- if .RateLimiter}}
+  - WithRateLimit, WithRateLimiter, WithKeyedRateLimiter, and WithRateLimiters limit the rate of requests
+{{- end}}
+{{- if .Adaptive}}
+  - WithAdaptiveRateLimiter adjusts the rate of requests to the quota published by the server
+{{- end}}
+{{- if .RetryAfter}}
+  - WithRetryAfter pauses requests while the server responds with Retry-After
+{{- end}}
+{{- if .Brotli}}
+  - WithBrotli decompresses brotli responses limited by WithMaxDecompressedSize
+{{- end}}
+{{- if .Middleware}}
+  - WithMiddleware wraps the transport with round tripper middleware in order
+{{- end}}
+{{- if .Hooks}}
+  - WithRequestHook and WithResponseHook inspect or modify requests and responses
+{{- end}}
+{{- if .Concurrency}}
+  - WithMaxConcurrency limits the number of requests in flight
+{{- end}}
+{{- if .Compression}}
+  - WithCompression decompresses gzip and deflate responses limited by WithMaxDecompressedSize
+{{- end}}
+{{- if .Cache}}
+  - WithMemoryCache, WithCacheDir, and WithConditionalCache cache responses
+{{- end}}
+{{- if .RequestIDs}}
+  - WithRequestID sets correlation ids on requests and the errors they return
+{{- end}}
+{{- if .Idempotency}}
+  - WithIdempotencyKeys sets idempotency keys on mutating requests
+{{- end}}
+{{- if .TTLCache}}
+  - WithResponseCache replays responses from a cache for a period
+{{- end}}
+{{- if .Queue}}
+  - WithQueue executes requests by priority with a fixed number of workers
+{{- end}}
+{{- if .Expvar}}
+  - WithExpvar publishes request counters with expvar
+{{- end}}
+{{- if .Clock}}
+  - WithClock sets the clock used for time keeping
+{{- end}}
+{{- if .Providers}}
+  - WithProvider adds the credentials of an oauth2 provider selected by UseProvider
+{{- end}}
+{{- if .Retry}}
+  - WithRetry retries transient failures of idempotent requests, see RetryUnsafe
+  - WithBackoff sets the delay between retries
+{{- end}}
+{{- if .Metrics}}
+  - WithMetrics records prometheus metrics for requests
+{{- end}}
+{{- if .BasicAuth}}
+  - WithBasicAuth authenticates requests with http basic authentication
+{{- end}}
+{{- if .Bearer}}
+  - WithBearerToken authenticates requests with a static bearer token
+{{- end}}
+{{- if .JWT}}
+  - WithJWTAssertion authorizes requests with tokens for signed jwt assertions
+{{- end}}
+{{- if .OAuth1}}
+  - WithOAuth1 signs requests with oauth1 consumer and token credentials
+{{- end}}
+{{- if .SigV4}}
+  - WithSigV4 signs requests with AWS Signature Version 4
+{{- end}}
+{{- if .HMAC}}
+  - WithHMACSigner signs requests with an hmac
+{{- end}}
+{{- if .Proxy}}
+  - WithProxy and WithProxyFromEnvironment send requests through a proxy
+{{- end}}
+{{- if .TLS}}
+  - WithTLSConfig, WithInsecureSkipVerify, and WithRootCAs configure tls
+  - WithClientCertificate authenticates the client with mutual tls
+{{- end}}
+{{- if .Timeout}}
+  - WithTimeout sets the time limit for requests
+{{- end}}
+{{- if .BaseURL}}
+  - WithBaseURL sets the base url of api requests
+{{- end}}
+{{- if .UserAgent}}
+  - WithUserAgent sets the User-Agent header
+{{- end}}
+{{- if .Logging}}
+  - WithLogger writes structured request logs
+{{- end}}
+{{- if .Otel}}
+  - WithOpenTelemetry creates spans for requests
+{{- end}}
+{{- if .Breaker}}
+  - WithCircuitBreaker fails fast while the upstream is degraded
+{{- end}}
+{{- if .Uploads}}
+  - WithUploadBaseURL, WithUploadHTTPClient, and WithUploadTransport configure the upload host
+{{- end}}
+{{- if .Curl}}
+  - WithCurlOnError writes failed requests as curl commands
+{{- end}}
+{{- if .Stats}}
+  - WithStats reports the outcome and latency of each request
+{{- end}}
+
+# Ordering
+
+Options are applied in order and when two options set the same value the last one
+wins. Options such as WithHTTPTracing{{if .RateLimiter}} and WithRateLimiter{{end}} wrap the transport
+configured so far, so the last applied is the first to see a request. WithTransport and
+WithHTTPClient replace the transport, including the transports of earlier options, so
+apply them first.
+{{- if .Client}}
+
+# Example
+
+	client, err := {{.Package}}.NewClient(
+{{- if .Token}}
+		{{.Package}}.WithTokenCredentials(accessToken, refreshToken, expiry),
+{{- end}}
+{{- if .RateLimiter}}
+		{{.Package}}.WithRateLimiter(rate.NewLimiter(rate.Every(time.Second), 10)),
+{{- end}}
+		{{.Package}}.WithHTTPTracing(debug),
+	)
+	if err != nil {
+		return err
+	}
+{{- end}}
+*/
+package {{.Package}}
+`
+
+	qhelpers = `// Code generated by "genwith {{.Flags}}"; DO NOT EDIT.
+
+package {{.Package}}_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"{{.ImportPath}}"
+)
+
+// handlerTransport serves requests in memory with the handler
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, req)
+	return w.Result(), nil
+}
+
+// serverTransport sends all requests to the server
+type serverTransport struct {
+	server *httptest.Server
+}
+
+func (t *serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.server.Listener.Addr().String()
+	return t.server.Client().Transport.RoundTrip(req)
+}
+
+// withHandler returns an Option serving all requests in memory with the handler
+func withHandler(handler http.Handler) {{.Package}}.Option {
+	return {{.Package}}.WithTransport(&handlerTransport{handler: handler})
+}
+
+// withServer returns an Option sending all requests to a fake server using the
+// handler, the server is closed when the test completes
+func withServer(t testing.TB, handler http.Handler) {{.Package}}.Option {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return {{.Package}}.WithTransport(&serverTransport{server: server})
+}
+
+// newTestClient returns a new client with requests served in memory by the handler
+func newTestClient(t testing.TB, handler http.Handler, opts ...{{.Package}}.Option) *{{.Package}}.Client {
+	t.Helper()
+	client, err := {{.Package}}.NewClient(append([]{{.Package}}.Option{withHandler(handler)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// fixture returns a handler responding with the status and contents of the file in testdata
+func fixture(t testing.TB, status int, name string) http.Handler {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	})
+}
+`
+)
+
+// importPath returns the import path of the package in the current directory
+func importPath(ctx context.Context) (string, error) {
+	b, err := exec.CommandContext(ctx, "go", "list", "-f", "{{.ImportPath}}", ".").CombinedOutput()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(string(b)))
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// output is a file generated from the concatenation of templates
+type output struct {
+	name  string
+	tmpls []string
+}
+
+func format(ctx context.Context, file string) error {
+	cmds := []*exec.Cmd{
+		exec.CommandContext(ctx, "gofmt", "-w", "-s", file),
+		exec.CommandContext(ctx, "goimports", "-w", file),
+	}
+	for _, cmd := range cmds {
+		b, err := cmd.CombinedOutput()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, strings.TrimSpace(string(b)))
+			return err
+		}
+	}
+	return nil
+}
+
+func generate(w with, file string, tmpls []string, renames map[string]string) error {
+	src := new(bytes.Buffer)
+	for _, tmpl := range tmpls {
+		t, err := template.New("genwith").Parse(tmpl)
+		if err != nil {
+			log.Error().Err(err).Msg("parsing template")
+			return err
+		}
+		err = t.Execute(src, w)
+		if err != nil {
+			log.Error().Err(err).Msg("executing template")
+			return err
+		}
+	}
+	var err error
+	b := src.Bytes()
+	if w.Name != "" {
+		b, err = rename(b, w.Name, renames)
+		if err != nil {
+			log.Error().Err(err).Msg("renaming identifiers")
+			return err
+		}
+	}
+	return os.WriteFile(file, b, 0600)
+}
+
+// write generates and formats the file in a temporary location, replacing the file
+// only if the result differs so unchanged files keep their modification time
+func write(ctx context.Context, w with, file output, renames map[string]string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file.name), ".genwith-*-"+filepath.Base(file.name))
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	defer func() {
+		// the file no longer exists if it was renamed
+		_ = os.Remove(name)
+	}()
+	if err = generate(w, name, file.tmpls, renames); err != nil {
+		return err
+	}
+	if err = format(ctx, name); err != nil {
+		return err
+	}
+	src, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if dst, readErr := os.ReadFile(file.name); readErr == nil && bytes.Equal(src, dst) {
+		return nil
+	}
+	return os.Rename(name, file.name)
+}
+
+// enabled returns true if the flag was set to a non-zero value
+func enabled(c *cli.Context, name string) bool {
+	switch v := c.Value(name).(type) {
+	case bool:
+		return v
+	case string:
+		return c.IsSet(name) && v != ""
+	default:
+		return c.IsSet(name)
+	}
+}
+
+// requires are the flags which generate code depending on the code of another flag
+var requires = []struct {
+	flag, required string
+}{
+	{"endpoint", "config"},
+	{"endpoint-func", "config"},
+	{"request-dump", "do"},
+	{"http-error", "do"},
+	{"request-id-header", "http-error"},
+	{"capture-body", "http-error"},
+	{"health", "do"},
+	{"health", "client"},
+	{"ping", "do"},
+	{"from-config", "client"},
+	{"from-env", "client"},
+	{"config-file", "client"},
+	{"request-options", "do"},
+	{"services", "client"},
+	{"rollback", "client"},
+	{"applied-options", "client"},
+	{"concurrency-safe", "client"},
+	{"token-source", "token"},
+	{"clock", "client"},
+	{"soft-errors", "do"},
+	{"brotli", "client"},
+	{"compression", "client"},
+	{"cache", "client"},
+	{"response-cache", "client"},
+	{"idempotency", "client"},
+	{"request-ids", "do"},
+	{"request-ids", "client"},
+	{"retry-after", "ratelimit"},
+	{"retry-after", "client"},
+	{"ratelimit-adaptive", "ratelimit"},
+	{"ratelimit-adaptive", "client"},
+	{"max-concurrency", "client"},
+	{"hooks", "do"},
+	{"hooks", "client"},
+	{"middleware", "client"},
+	{"gen-fault", "do"},
+	{"error-map", "do"},
+	{"do-response", "do"},
+	{"no-content-error", "do"},
+	{"queue", "client"},
+	{"batch", "do"},
+	{"generics", "do"},
+	{"builder", "do"},
+	{"stream", "do"},
+	{"sse", "do"},
+	{"websocket", "client"},
+	{"multipart", "do"},
+	{"download", "do"},
+	{"expvar", "client"},
+	{"bench", "do"},
+	{"bench", "client"},
+	{"test-helpers", "client"},
+	{"shutdown", "do"},
+	{"shutdown", "client"},
+	{"stats", "do"},
+	{"stats", "client"},
+	{"providers", "client"},
+	{"curl", "do"},
+	{"curl", "client"},
+	{"uploads", "do"},
+	{"uploads", "client"},
+	{"retry", "client"},
+	{"circuitbreaker", "client"},
+	{"metrics", "client"},
+	{"otel", "client"},
+	{"logging", "client"},
+	{"useragent", "client"},
+	{"base-url", "client"},
+	{"timeout", "client"},
+	{"proxy", "client"},
+	{"tls", "client"},
+	{"basicauth", "client"},
+	{"bearer", "client"},
+	{"hmac", "client"},
+	{"sigv4", "client"},
+	{"client-credentials", "config"},
+	{"pkce", "config"},
+	{"device-flow", "config"},
+	{"oauth1", "client"},
+	{"jwt", "client"},
+	{"refresh-hook", "token"},
+	{"token-store", "token"},
+	{"expiry-leeway", "token"},
+	{"expiry-leeway", "client"},
+}
+
+func validate(c *cli.Context) error {
+	if c.Bool("endpoint") && c.Bool("endpoint-func") {
+		return errors.New("only one of --endpoint or --endpoint-func allowed")
+	}
+	for _, name := range []string{"refresh-hook", "token-store", "expiry-leeway"} {
+		if c.Bool(name) && !c.Bool("endpoint") && !c.Bool("endpoint-func") {
+			return fmt.Errorf("--%s requires --endpoint or --endpoint-func", name)
+		}
+	}
+	for _, name := range []string{"from-env", "config-file"} {
+		if c.Bool(name) && !c.Bool("config") && !c.Bool("token") && !enabled(c, "base-url") {
+			return fmt.Errorf("--%s requires --config, --token, or --base-url", name)
+		}
+	}
+	if name := c.String("name"); name != "" && !token.IsExported(name) {
+		return fmt.Errorf("--name '%s' must be an exported identifier", name)
+	}
+	if c.String("name") != "" && c.Bool("doc") {
+		// the package has one doc comment, documented by the default client
+		return errors.New("--doc is not allowed with --name")
+	}
+	if name := c.String("fault-type"); !token.IsIdentifier(name) {
+		return fmt.Errorf("--fault-type '%s' must be an identifier", name)
+	}
+	for _, v := range c.StringSlice("var") {
+		if key, _, ok := strings.Cut(v, "="); !ok || key == "" {
+			return fmt.Errorf("--var '%s' must be of the form key=value", v)
+		}
+	}
+	if _, err := errorMap(c.StringSlice("error-map")); err != nil {
+		return err
+	}
+	for _, v := range c.StringSlice("endpoints") {
+		key, value, _ := strings.Cut(v, "=")
+		switch key {
+		case "baseURL":
+		case "authURL", "tokenURL":
+			if !c.Bool("endpoint") && !c.Bool("endpoint-func") {
+				return fmt.Errorf("--endpoints %s requires --endpoint or --endpoint-func", key)
+			}
+		default:
+			return fmt.Errorf("--endpoints '%s' must be of the form baseURL, authURL, or tokenURL=url", v)
+		}
+		if u, err := url.Parse(value); err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("--endpoints '%s' is not an absolute url", v)
+		}
+	}
+	for _, name := range c.StringSlice("services") {
+		if !token.IsIdentifier(name) {
+			return fmt.Errorf("--services '%s' must be an identifier", name)
+		}
+	}
+	switch c.String("encoder") {
+	case "", "json", "xml", "form":
+	default:
+		return fmt.Errorf("unknown encoder '%s'", c.String("encoder"))
+	}
+	if c.String("decoder") == "custom" && !c.Bool("client") {
+		return errors.New("--decoder custom requires --client")
+	}
+	switch c.String("style") {
+	case "options":
+	case "builder":
+		if !c.Bool("client") {
+			return errors.New("--style builder requires --client")
+		}
+	default:
+		return fmt.Errorf("unknown style '%s'", c.String("style"))
+	}
+	for _, r := range requires {
+		if enabled(c, r.flag) && !enabled(c, r.required) {
+			return fmt.Errorf("--%s requires --%s", r.flag, r.required)
+		}
+	}
+	if enabled(c, "base-url") {
+		u, err := url.Parse(c.String("base-url"))
+		if err != nil {
+			return err
+		}
+		if !u.IsAbs() || u.Host == "" || u.RawQuery != "" {
+			return fmt.Errorf("--base-url must be an absolute url without a query")
+		}
+	}
+	if enabled(c, "ping") && !enabled(c, "base-url") {
+		// the path of the ping is joined to the base url
+		if u, err := url.Parse(c.String("ping")); err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("--ping '%s' must be an absolute url without --base-url", c.String("ping"))
+		}
+	}
+	if c.Bool("oauth1") {
+		// oauth1 replaces the oauth2 configuration and token
+		for _, name := range []string{"token", "config"} {
+			if c.Bool(name) {
+				return fmt.Errorf("--oauth1 does not allow --%s", name)
+			}
+		}
+	}
+	if c.Bool("minimal") {
+		// these flags generate code depending on modules outside the standard library
+		for _, name := range []string{"token", "config", "ratelimit", "brotli", "providers", "metrics", "otel", "sigv4", "jwt", "websocket", "config-file"} {
+			if c.Bool(name) {
+				return fmt.Errorf("--minimal does not allow --%s", name)
+			}
+		}
+		if c.String("decoder") == "msgpack" {
+			return errors.New("--minimal does not allow --decoder msgpack")
+		}
+	}
+	return nil
+}
+
+func newApp() *cli.App {
+	return &cli.App{
+		Name:     "genwith",
+		Usage:    "Generate new functional option clients",
+		HelpName: "genwith",
+		Description: "The package declares the Client and the unexported fields used by the generated code,\n" +
+			"the generated file begins with a comment listing the fields required by its flags.",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
 				Name:  "token",
 				Value: false,
 				Usage: "Include token-related options",
@@ -280,7 +5546,7 @@ func main() {
 			&cli.BoolFlag{
 				Name:  "config",
 				Value: false,
-				Usage: "Include config-related options",
+				Usage: "Include config-related options and the AuthCodeURL and Exchange methods",
 			},
 			&cli.BoolFlag{
 				Name:  "endpoint",
@@ -292,6 +5558,10 @@ func main() {
 				Value: false,
 				Usage: "Include oauth2.Endpoint func in config instantiation",
 			},
+			&cli.StringSliceFlag{
+				Name:  "endpoints",
+				Usage: "A baseURL, authURL, or tokenURL=url generating the url constants and the Endpoint var or func",
+			},
 			&cli.BoolFlag{
 				Name:  "do",
 				Value: false,
@@ -307,28 +5577,415 @@ func main() {
 				Value: false,
 				Usage: "Include a rate limiting transport option",
 			},
+			&cli.BoolFlag{
+				Name:  "ratelimit-adaptive",
+				Value: false,
+				Usage: "Include a WithAdaptiveRateLimiter option adjusting the rate from X-RateLimit headers",
+			},
+			&cli.BoolFlag{
+				Name:  "retry-after",
+				Value: false,
+				Usage: "Include a WithRetryAfter option pausing requests for the Retry-After of throttled responses",
+			},
+			&cli.BoolFlag{
+				Name:  "max-concurrency",
+				Value: false,
+				Usage: "Include a WithMaxConcurrency option limiting the number of requests in flight",
+			},
+			&cli.BoolFlag{
+				Name:  "request-dump",
+				Value: false,
+				Usage: "Include a sanitized request dump in errors returned by client.do",
+			},
+			&cli.BoolFlag{
+				Name:  "http-error",
+				Value: false,
+				Usage: "Wrap faults returned by client.do in an HTTPError with the method, url, and status code",
+			},
+			&cli.BoolFlag{
+				Name:  "capture-body",
+				Value: false,
+				Usage: "Include a truncated copy of the error response body in HTTPError",
+			},
+			&cli.StringSliceFlag{
+				Name:  "services",
+				Usage: "A service of the client, such as activity, generating withServices and a services struct to embed in the Client",
+			},
+			&cli.StringSliceFlag{
+				Name:  "error-map",
+				Usage: "A code=name sentinel error wrapped by do for responses with the status code, such as 404=ErrNotFound",
+			},
+			&cli.BoolFlag{
+				Name:  "health",
+				Value: false,
+				Usage: "Include a Health accessor reporting rolling error rates per endpoint class",
+			},
+			&cli.StringFlag{
+				Name:  "request-id-header",
+				Value: "X-Request-Id",
+				Usage: "The response header copied into HTTPError.RequestID",
+			},
+			&cli.StringFlag{
+				Name:  "fault-type",
+				Value: "Fault",
+				Usage: "The error type, with Code and Message fields, decoded by do from error responses",
+			},
+			&cli.BoolFlag{
+				Name:  "gen-fault",
+				Value: false,
+				Usage: "Generate the error type named by --fault-type with tags for the decoder",
+			},
+			&cli.StringFlag{
+				Name:  "ping",
+				Value: "",
+				Usage: "Include a Ping method requesting the url, or the path joined to --base-url, for readiness probes",
+			},
+			&cli.BoolFlag{
+				Name:  "from-config",
+				Value: false,
+				Usage: "Include a Config struct and NewClientFromConfig constructor",
+			},
+			&cli.BoolFlag{
+				Name:  "from-env",
+				Value: false,
+				Usage: "Include a NewClientFromEnv constructor reading credentials and the base url from the environment",
+			},
+			&cli.BoolFlag{
+				Name:  "config-file",
+				Value: false,
+				Usage: "Include a WithConfigFile option reading credentials and the base url from a json or yaml file",
+			},
+			&cli.BoolFlag{
+				Name:  "rollback",
+				Value: false,
+				Usage: "Undo partially applied options if NewClient fails, restoring the transport of a client from WithHTTPClient and releasing the metrics and cache directory options' resources",
+			},
+			&cli.BoolFlag{
+				Name:  "applied-options",
+				Value: false,
+				Usage: "Record the names of applied options for introspection",
+			},
+			&cli.BoolFlag{
+				Name:  "concurrency-safe",
+				Value: false,
+				Usage: "Guard mutable client state and include copying accessors",
+			},
+			&cli.BoolFlag{
+				Name:  "token-source",
+				Value: false,
+				Usage: "Include a Token method so the client satisfies oauth2.TokenSource",
+			},
+			&cli.BoolFlag{
+				Name:  "clock",
+				Value: false,
+				Usage: "Include an injectable clock option",
+			},
+			&cli.BoolFlag{
+				Name:  "soft-errors",
+				Value: false,
+				Usage: "Call the package's softError(v interface{}) error on values decoded from successful responses",
+			},
+			&cli.BoolFlag{
+				Name:  "brotli",
+				Value: false,
+				Usage: "Include a brotli response decompression option",
+			},
+			&cli.BoolFlag{
+				Name:  "compression",
+				Value: false,
+				Usage: "Include a gzip and deflate response decompression option",
+			},
+			&cli.BoolFlag{
+				Name:  "cache",
+				Value: false,
+				Usage: "Include conditional request caching options with memory and disk backends",
+			},
+			&cli.BoolFlag{
+				Name:  "response-cache",
+				Value: false,
+				Usage: "Include a WithResponseCache option replaying GET responses for a period",
+			},
+			&cli.BoolFlag{
+				Name:  "queue",
+				Value: false,
+				Usage: "Include a priority request queue option",
+			},
+			&cli.BoolFlag{
+				Name:  "batch",
+				Value: false,
+				Usage: "Include a Batch method executing requests with bounded concurrency",
+			},
+			&cli.BoolFlag{
+				Name:  "expvar",
+				Value: false,
+				Usage: "Include an option publishing client metrics with expvar",
+			},
+			&cli.BoolFlag{
+				Name:  "bench",
+				Value: false,
+				Usage: "Generate benchmarks for client.do in a _with_bench_test.go file",
+			},
+			&cli.BoolFlag{
+				Name:  "minimal",
+				Value: false,
+				Usage: "Generate code using only the standard library, for tinygo and js/wasm",
+			},
+			&cli.StringFlag{
+				Name:  "name",
+				Value: "",
+				Usage: "The name of a client variant, prefixing the generated identifiers and file",
+			},
+			&cli.BoolFlag{
+				Name:  "test-helpers",
+				Value: false,
+				Usage: "Generate test helpers in the external test package in a _with_helpers_test.go file",
+			},
+			&cli.StringSliceFlag{
+				Name:  "var",
+				Usage: "A key=value variable available to templates as {{.Vars.key}}, may be repeated",
+			},
+			&cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "A template file rendered and appended to the generated file, may be repeated",
+			},
+			&cli.BoolFlag{
+				Name:  "wrap-errors",
+				Value: false,
+				Usage: "Wrap errors from client.do and options with context for errors.Is and errors.As",
+			},
+			&cli.BoolFlag{
+				Name:  "shutdown",
+				Value: false,
+				Usage: "Include a Shutdown method which waits for in-flight requests to finish",
+			},
+			&cli.BoolFlag{
+				Name:  "stats",
+				Value: false,
+				Usage: "Include a WithStats option called with the outcome and latency of each request",
+			},
+			&cli.BoolFlag{
+				Name:  "hooks",
+				Value: false,
+				Usage: "Include WithRequestHook and WithResponseHook options called by do",
+			},
+			&cli.BoolFlag{
+				Name:  "do-response",
+				Value: false,
+				Usage: "Include a doResponse variant of do returning the response for its headers",
+			},
+			&cli.BoolFlag{
+				Name:  "no-content-error",
+				Value: false,
+				Usage: "Return ErrNoContent from do for a 204 or HEAD response when a value was expected, rather than leaving the value unchanged",
+			},
+			&cli.BoolFlag{
+				Name:  "request-options",
+				Value: false,
+				Usage: "Include a RequestOption type passed to do for per-call headers, query parameters, and timeouts",
+			},
+			&cli.BoolFlag{
+				Name:  "middleware",
+				Value: false,
+				Usage: "Include a WithMiddleware option composing round tripper middleware",
+			},
+			&cli.BoolFlag{
+				Name:  "doc",
+				Value: false,
+				Usage: "Generate a doc.go documenting the generated options and the flags used, without --name",
+			},
+			&cli.BoolFlag{
+				Name:  "providers",
+				Value: false,
+				Usage: "Include a WithProvider option for credentials of multiple oauth2 providers selected per request",
+			},
+			&cli.BoolFlag{
+				Name:  "curl",
+				Value: false,
+				Usage: "Include a WithCurlOnError option writing failed requests as curl commands",
+			},
+			&cli.BoolFlag{
+				Name:  "uploads",
+				Value: false,
+				Usage: "Include a second http client and base url for a separate upload and download host, sending requests with the api client's transport by default",
+			},
+			&cli.BoolFlag{
+				Name:  "retry",
+				Value: false,
+				Usage: "Include a WithRetry option retrying transient failures of idempotent requests",
+			},
+			&cli.BoolFlag{
+				Name:  "circuitbreaker",
+				Value: false,
+				Usage: "Include a WithCircuitBreaker option failing fast after consecutive failures",
+			},
+			&cli.BoolFlag{
+				Name:  "metrics",
+				Value: false,
+				Usage: "Include a WithMetrics option recording prometheus metrics for requests",
+			},
+			&cli.BoolFlag{
+				Name:  "otel",
+				Value: false,
+				Usage: "Include a WithOpenTelemetry option creating spans for requests",
+			},
+			&cli.BoolFlag{
+				Name:  "logging",
+				Value: false,
+				Usage: "Include a WithLogger option writing structured request logs with log/slog",
+			},
+			&cli.BoolFlag{
+				Name:  "request-ids",
+				Value: false,
+				Usage: "Include a WithRequestID option setting correlation ids on requests and their errors",
+			},
+			&cli.BoolFlag{
+				Name:  "idempotency",
+				Value: false,
+				Usage: "Include a WithIdempotencyKeys option setting unique keys on mutating requests",
+			},
+			&cli.BoolFlag{
+				Name:  "useragent",
+				Value: false,
+				Usage: "Include a WithUserAgent option setting the User-Agent header of requests",
+			},
+			&cli.BoolFlag{
+				Name:  "timeout",
+				Value: false,
+				Usage: "Include a WithTimeout option setting the timeout of the http client",
+			},
+			&cli.BoolFlag{
+				Name:  "proxy",
+				Value: false,
+				Usage: "Include WithProxy and WithProxyFromEnvironment options",
+			},
+			&cli.BoolFlag{
+				Name:  "tls",
+				Value: false,
+				Usage: "Include WithTLSConfig, WithInsecureSkipVerify, WithRootCAs, and WithClientCertificate options",
+			},
+			&cli.BoolFlag{
+				Name:  "basicauth",
+				Value: false,
+				Usage: "Include a WithBasicAuth option for http basic authentication",
+			},
+			&cli.BoolFlag{
+				Name:  "bearer",
+				Value: false,
+				Usage: "Include a WithBearerToken option for static bearer token authentication",
+			},
+			&cli.StringFlag{
+				Name:  "hmac",
+				Usage: "The header for request signatures, includes a WithHMACSigner option",
+			},
+			&cli.BoolFlag{
+				Name:  "client-credentials",
+				Value: false,
+				Usage: "Include a WithClientCredentialsFlow option for the oauth2 client credentials flow",
+			},
+			&cli.BoolFlag{
+				Name:  "pkce",
+				Value: false,
+				Usage: "Include AuthCodeURLWithPKCE and ExchangeWithPKCE methods for the authorization code flow with PKCE",
+			},
+			&cli.BoolFlag{
+				Name:  "device-flow",
+				Value: false,
+				Usage: "Include DeviceAuth and PollToken methods for the oauth2 device authorization flow",
+			},
+			&cli.BoolFlag{
+				Name:  "oauth1",
+				Value: false,
+				Usage: "Include a WithOAuth1 option signing requests with oauth1 in place of oauth2",
+			},
+			&cli.BoolFlag{
+				Name:  "jwt",
+				Value: false,
+				Usage: "Include a WithJWTAssertion option for the oauth2 jwt bearer assertion flow",
+			},
+			&cli.BoolFlag{
+				Name:  "refresh-hook",
+				Value: false,
+				Usage: "Include a WithTokenRefreshHook option called with refreshed tokens",
+			},
+			&cli.BoolFlag{
+				Name:  "token-store",
+				Value: false,
+				Usage: "Include a TokenStore with file and memory implementations for saving refreshed tokens",
+			},
+			&cli.BoolFlag{
+				Name:  "expiry-leeway",
+				Value: false,
+				Usage: "Include a WithTokenExpiryLeeway option refreshing tokens before they expire",
+			},
+			&cli.BoolFlag{
+				Name:  "sigv4",
+				Value: false,
+				Usage: "Include a WithSigV4 option signing requests with AWS Signature Version 4",
+			},
+			&cli.BoolFlag{
+				Name:  "download",
+				Value: false,
+				Usage: "Include a download function streaming response bodies to a writer with progress",
+			},
+			&cli.BoolFlag{
+				Name:  "multipart",
+				Value: false,
+				Usage: "Include an uploadMultipart function streaming multipart forms of fields and files",
+			},
+			&cli.BoolFlag{
+				Name:  "websocket",
+				Value: false,
+				Usage: "Include a Dial method opening websocket connections with the client's authorization",
+			},
+			&cli.BoolFlag{
+				Name:  "sse",
+				Value: false,
+				Usage: "Include an Events method streaming server-sent events with reconnection",
+			},
+			&cli.BoolFlag{
+				Name:  "stream",
+				Value: false,
+				Usage: "Include a doStream function returning response bodies for the caller to read",
+			},
+			&cli.BoolFlag{
+				Name:  "builder",
+				Value: false,
+				Usage: "Include a fluent Request builder executing requests with client.do",
+			},
+			&cli.BoolFlag{
+				Name:  "generics",
+				Value: false,
+				Usage: "Include do[T] and get[T] functions returning typed results from client.do",
+			},
+			&cli.StringFlag{
+				Name:  "base-url",
+				Usage: "The default base url of api requests, includes WithBaseURL and newAPIRequest",
+			},
+			&cli.StringFlag{
+				Name:  "style",
+				Value: "options",
+				Usage: "The style of client construction, one of 'options' or 'builder'",
+			},
 			&cli.StringFlag{
 				Name:     "package",
 				Value:    "",
 				Required: true,
 				Usage:    "The name of the package for generation",
 			},
+			&cli.StringFlag{
+				Name:  "encoder",
+				Value: "",
+				Usage: "The encoder of request bodies, one of 'json', 'xml', or 'form', includes newRequest",
+			},
 			&cli.StringFlag{
 				Name:  "decoder",
 				Value: "json",
-				Usage: "The decoder to use",
+				Usage: "The decoder to use, such as 'json', 'xml', or 'msgpack', or 'ndjson' to stream objects to a func(interface{}) error, or 'custom' for a WithDecoder option, or 'auto' to choose json or xml by content type",
 			},
 		},
-		Before: func(c *cli.Context) error {
-			if c.Bool("endpoint") && c.Bool("endpoint-func") {
-				return errors.New("only one of --endpoint or --endpoint-func allowed")
-			}
-			if c.Bool("endpoint") || c.Bool("endpoint-func") {
-				if !c.Bool("config") {
-					return errors.New("--endpoint or --endpoint-func requires --config")
-				}
-			}
-			return nil
+		Before: validate,
+		Commands: []*cli.Command{
+			openapiCommand(),
 		},
 		ExitErrHandler: func(c *cli.Context, err error) {
 			if err == nil {
@@ -345,16 +6002,158 @@ func main() {
 				EndpointFunc: c.Bool("endpoint-func"),
 				Client:       c.Bool("client"),
 				RateLimiter:  c.Bool("ratelimit"),
+				RequestDump:  c.Bool("request-dump"),
+				HTTPError:    c.Bool("http-error"),
+				Health:       c.Bool("health"),
 				Flags:        strings.Join(os.Args[1:], " "),
 				Package:      c.String("package"),
-				Decoder:      c.String("decoder")}
-			file := fmt.Sprintf("%s_with.go", c.String("package"))
-			if err := generate(w, file, q); err != nil {
-				return err
+				Decoder:      c.String("decoder"),
+				Encoder:      c.String("encoder"),
+				Generics:     c.Bool("generics"),
+				Fluent:       c.Bool("builder"),
+				Stream:       c.Bool("stream"),
+				SSE:          c.Bool("sse"),
+				WebSocket:    c.Bool("websocket"),
+				Multipart:    c.Bool("multipart"),
+				Download:     c.Bool("download"),
+				Compression:  c.Bool("compression"),
+				TTLCache:     c.Bool("response-cache"),
+				Idempotency:  c.Bool("idempotency"),
+				RequestIDs:   c.Bool("request-ids"),
+				RetryAfter:   c.Bool("retry-after"),
+				Adaptive:     c.Bool("ratelimit-adaptive"),
+				Concurrency:  c.Bool("max-concurrency"),
+				Hooks:        c.Bool("hooks"),
+				Middleware:   c.Bool("middleware"),
+				RequestID:    c.String("request-id-header"),
+				Fault:        c.String("fault-type"),
+				Ping:         c.String("ping"),
+				Name:         c.String("name"),
+				Builder:      c.String("style") == "builder",
+				FromConfig:   c.Bool("from-config"),
+				FromEnv:      c.Bool("from-env"),
+				ConfigFile:   c.Bool("config-file"),
+				RequestOpts:  c.Bool("request-options"),
+				Rollback:     c.Bool("rollback"),
+				Applied:      c.Bool("applied-options"),
+				Safe:         c.Bool("concurrency-safe"),
+				TokenSource:  c.Bool("token-source"),
+				Clock:        c.Bool("clock"),
+				SoftErrors:   c.Bool("soft-errors"),
+				Brotli:       c.Bool("brotli"),
+				Cache:        c.Bool("cache"),
+				Queue:        c.Bool("queue"),
+				Batch:        c.Bool("batch"),
+				Expvar:       c.Bool("expvar"),
+				Bench:        c.Bool("bench"),
+				Minimal:      c.Bool("minimal"),
+				Helpers:      c.Bool("test-helpers"),
+				WrapErrors:   c.Bool("wrap-errors"),
+				Shutdown:     c.Bool("shutdown"),
+				Stats:        c.Bool("stats"),
+				Doc:          c.Bool("doc"),
+				Providers:    c.Bool("providers"),
+				Curl:         c.Bool("curl"),
+				Uploads:      c.Bool("uploads"),
+				Retry:        c.Bool("retry"),
+				Breaker:      c.Bool("circuitbreaker"),
+				Metrics:      c.Bool("metrics"),
+				Otel:         c.Bool("otel"),
+				Logging:      c.Bool("logging"),
+				UserAgent:    c.Bool("useragent"),
+				Timeout:      c.Bool("timeout"),
+				Proxy:        c.Bool("proxy"),
+				TLS:          c.Bool("tls"),
+				BasicAuth:    c.Bool("basicauth"),
+				Bearer:       c.Bool("bearer"),
+				HMAC:         c.String("hmac"),
+				SigV4:        c.Bool("sigv4"),
+				TwoLegged:    c.Bool("client-credentials"),
+				PKCE:         c.Bool("pkce"),
+				DeviceFlow:   c.Bool("device-flow"),
+				OAuth1:       c.Bool("oauth1"),
+				JWT:          c.Bool("jwt"),
+				RefreshHook:  c.Bool("refresh-hook"),
+				TokenStore:   c.Bool("token-store"),
+				Leeway:       c.Bool("expiry-leeway"),
+				GenFault:     c.Bool("gen-fault"),
+				CaptureBody:  c.Bool("capture-body"),
+				DoResponse:   c.Bool("do-response"),
+				NoContent:    c.Bool("no-content-error"),
+				Vars:         make(map[string]string),
+				Endpoints:    make(map[string]string)}
+			switch w.Decoder {
+			case "ndjson":
+				// newline delimited streams are decoded with encoding/json
+				w.Decoder, w.NDJSON = "json", true
+			case "custom":
+				// the default decoder of the client is encoding/json
+				w.Decoder, w.Custom = "json", true
+			case "auto":
+				// responses are decoded by content type with encoding/json or encoding/xml
+				w.Decoder, w.Auto = "json", true
+			}
+			if enabled(c, "base-url") {
+				var err error
+				w.BaseURL, err = url.Parse(c.String("base-url"))
+				if err != nil {
+					return err
+				}
+			}
+			for _, v := range c.StringSlice("var") {
+				key, value, _ := strings.Cut(v, "=")
+				w.Vars[key] = value
 			}
-			return format(c.Context, file)
+			w.ErrorMap, _ = errorMap(c.StringSlice("error-map"))
+			for _, name := range c.StringSlice("services") {
+				w.Services = append(w.Services, strings.ToUpper(name[:1])+name[1:])
+			}
+			for _, v := range c.StringSlice("endpoints") {
+				key, value, _ := strings.Cut(v, "=")
+				w.Endpoints[key] = value
+			}
+			prefix := w.Package
+			if w.Name != "" {
+				prefix += "_" + strings.ToLower(w.Name)
+			}
+			tmpls := []string{q}
+			for _, include := range c.StringSlice("include") {
+				b, err := os.ReadFile(include)
+				if err != nil {
+					return err
+				}
+				tmpls = append(tmpls, string(b))
+			}
+			files := []output{
+				{prefix + "_with.go", tmpls},
+			}
+			if w.Bench {
+				files = append(files, output{prefix + "_with_bench_test.go", []string{qbench}})
+			}
+			if w.Helpers {
+				var err error
+				w.ImportPath, err = importPath(c.Context)
+				if err != nil {
+					return err
+				}
+				files = append(files, output{prefix + "_with_helpers_test.go", []string{qhelpers}})
+			}
+			if w.Doc {
+				files = append(files, output{"doc.go", []string{qdoc}})
+			}
+			renames := hooks(w.Name)
+			for _, file := range files {
+				if err := write(c.Context, w, file, renames); err != nil {
+					return err
+				}
+			}
+			return nil
 		},
 	}
+}
+
+func main() {
+	app := newApp()
 	if err := app.RunContext(context.Background(), os.Args); err != nil {
 		os.Exit(1)
 	}
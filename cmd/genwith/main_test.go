@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// values are the values of the flags which are not booleans
+var values = map[string]string{
+	"endpoints":         "baseURL=https://example.com/api",
+	"services":          "activity",
+	"error-map":         "404=ErrNotFound",
+	"request-id-header": "X-Trace-Id",
+	"fault-type":        "Failure",
+	"ping":              "https://example.com/ping",
+	"name":              "Up",
+	"var":               "key=value",
+	"hmac":              "X-Signature",
+	"base-url":          "https://example.com/api",
+	"style":             "builder",
+	"encoder":           "form",
+	"decoder":           "xml",
+}
+
+// needs are the flags a flag depends on which are not in requires
+var needs = map[string][]string{
+	"refresh-hook":  {"endpoint"},
+	"token-store":   {"endpoint"},
+	"expiry-leeway": {"endpoint"},
+	"from-env":      {"token"},
+	"config-file":   {"token"},
+	"style":         {"client"},
+	"ping":          {"client"},
+}
+
+// args returns the arguments enabling the flag and the flags it depends on
+func args(flag string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		out = append(out, "--"+name)
+		if value, ok := values[name]; ok {
+			out = append(out, value)
+		}
+		for _, r := range requires {
+			if r.flag == name {
+				walk(r.required)
+			}
+		}
+		for _, need := range needs[name] {
+			walk(need)
+		}
+	}
+	walk(flag)
+	return out
+}
+
+// value returns the value of the flag in the arguments
+func value(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--"+flag {
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				return args[i+1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// run genwith in the directory
+func run(t *testing.T, dir string, args ...string) error {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	return newApp().RunContext(context.Background(), append([]string{"genwith"}, args...))
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string][]string{
+		"endpoint and endpoint-func":    {"--config", "--endpoint", "--endpoint-func"},
+		"unknown style":                 {"--style", "functional"},
+		"minimal and token":             {"--client", "--minimal", "--token"},
+		"minimal and msgpack":           {"--client", "--minimal", "--decoder", "msgpack"},
+		"unexported name":               {"--name", "up"},
+		"relative base url":             {"--client", "--base-url", "/api"},
+		"oauth1 and token":              {"--client", "--oauth1", "--token"},
+		"refresh hook without endpoint": {"--token", "--refresh-hook"},
+		"unknown encoder":               {"--encoder", "yaml"},
+		"endpoints without endpoint":    {"--config", "--endpoints", "tokenURL=https://example.com/token"},
+		"relative ping":                 {"--client", "--do", "--ping", "/health"},
+		"doc for a variant":             {"--name", "Up", "--doc"},
+	}
+	// each flag without a flag it requires
+	for _, r := range requires {
+		var without []string
+		for _, arg := range args(r.flag) {
+			if arg != "--"+r.required {
+				without = append(without, arg)
+			}
+		}
+		tests[fmt.Sprintf("%s without %s", r.flag, r.required)] = without
+	}
+	for name, args := range tests {
+		args = append([]string{"--package", "gw"}, args...)
+		t.Run(name, func(t *testing.T) {
+			if err := run(t, t.TempDir(), args...); err == nil {
+				t.Errorf("genwith %s: expected an error", strings.Join(args, " "))
+			}
+		})
+	}
+}
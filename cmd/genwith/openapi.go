@@ -0,0 +1,548 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// openapi is the subset of an OpenAPI 3 document used for generation
+type openapi struct {
+	OpenAPI    string                     `yaml:"openapi"`
+	Paths      map[string]openapiPathItem `yaml:"paths"`
+	Components struct {
+		Schemas    map[string]*openapiSchema   `yaml:"schemas"`
+		Parameters map[string]openapiParameter `yaml:"parameters"`
+	} `yaml:"components"`
+}
+
+type openapiPathItem struct {
+	Parameters []openapiParameter `yaml:"parameters"`
+	Get        *openapiOperation  `yaml:"get"`
+	Put        *openapiOperation  `yaml:"put"`
+	Post       *openapiOperation  `yaml:"post"`
+	Delete     *openapiOperation  `yaml:"delete"`
+	Patch      *openapiOperation  `yaml:"patch"`
+}
+
+// operations returns the operations of the path item by http method
+func (p openapiPathItem) operations() map[string]*openapiOperation {
+	ops := map[string]*openapiOperation{
+		http.MethodGet:    p.Get,
+		http.MethodPut:    p.Put,
+		http.MethodPost:   p.Post,
+		http.MethodDelete: p.Delete,
+		http.MethodPatch:  p.Patch,
+	}
+	for method, op := range ops {
+		if op == nil {
+			delete(ops, method)
+		}
+	}
+	return ops
+}
+
+type openapiOperation struct {
+	OperationID string                 `yaml:"operationId"`
+	Summary     string                 `yaml:"summary"`
+	Tags        []string               `yaml:"tags"`
+	Parameters  []openapiParameter     `yaml:"parameters"`
+	RequestBody *openapiBody           `yaml:"requestBody"`
+	Responses   map[string]openapiBody `yaml:"responses"`
+}
+
+type openapiParameter struct {
+	Ref      string         `yaml:"$ref"`
+	Name     string         `yaml:"name"`
+	In       string         `yaml:"in"`
+	Required bool           `yaml:"required"`
+	Schema   *openapiSchema `yaml:"schema"`
+}
+
+type openapiBody struct {
+	Content map[string]struct {
+		Schema *openapiSchema `yaml:"schema"`
+	} `yaml:"content"`
+}
+
+// schema returns the schema of the json content of the body
+func (b *openapiBody) schema() *openapiSchema {
+	if b == nil {
+		return nil
+	}
+	for mediatype, content := range b.Content {
+		if mediatype == "application/json" || strings.HasSuffix(mediatype, "+json") {
+			return content.Schema
+		}
+	}
+	return nil
+}
+
+type openapiSchema struct {
+	Ref                  string                    `yaml:"$ref"`
+	Type                 string                    `yaml:"type"`
+	Format               string                    `yaml:"format"`
+	Description          string                    `yaml:"description"`
+	Items                *openapiSchema            `yaml:"items"`
+	Properties           map[string]*openapiSchema `yaml:"properties"`
+	Required             []string                  `yaml:"required"`
+	AdditionalProperties interface{}               `yaml:"additionalProperties"`
+}
+
+// api is the view of the OpenAPI document rendered by qopenapi
+type api struct {
+	Models   []apiModel
+	Services []apiService
+}
+
+type apiModel struct {
+	Name   string
+	Doc    string
+	Type   string
+	Fields []apiField
+}
+
+type apiField struct {
+	Name string
+	Type string
+	Tag  string
+}
+
+type apiService struct {
+	Name       string
+	Operations []apiOperation
+}
+
+type apiOperation struct {
+	Name    string
+	Summary string
+	Verb    string
+	Method  string
+	Path    string
+	// Format and Args build the path of the request with fmt.Sprintf
+	Format  string
+	Args    []string
+	Params  []apiField
+	Query   bool
+	Body    string
+	Result  string
+	Pointer bool
+}
+
+// initialisms are written in upper case in identifiers
+var initialisms = map[string]bool{
+	"API": true, "HTML": true, "HTTP": true, "ID": true, "JSON": true,
+	"URI": true, "URL": true, "UUID": true, "XML": true,
+}
+
+var words = regexp.MustCompile(`[A-Z]+[a-z0-9]*|[a-z0-9]+`)
+
+// exported returns the exported Go identifier for the name
+func exported(name string) string {
+	var b strings.Builder
+	for _, word := range words.FindAllString(strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return -1
+		}
+		return r
+	}, name), -1) {
+		switch upper := strings.ToUpper(word); {
+		case initialisms[upper]:
+			b.WriteString(upper)
+		default:
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	s := b.String()
+	if s == "" || !unicode.IsLetter(rune(s[0])) {
+		s = "X" + s
+	}
+	return s
+}
+
+// unexported returns the unexported Go identifier for the name
+func unexported(name string) string {
+	s := exported(name)
+	n := 1
+	for n < len(s) && unicode.IsUpper(rune(s[n])) && (n+1 == len(s) || unicode.IsUpper(rune(s[n+1]))) {
+		n++
+	}
+	s = strings.ToLower(s[:n]) + s[n:]
+	if token.IsKeyword(s) {
+		s += "Param"
+	}
+	return s
+}
+
+// readOpenAPI reads the OpenAPI 3 document, in yaml or json, from the file
+func readOpenAPI(path string) (*openapi, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := &openapi{}
+	if err = yaml.Unmarshal(b, doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("%s: unsupported openapi version '%s'", path, doc.OpenAPI)
+	}
+	return doc, nil
+}
+
+// goType returns the Go type of the schema
+func (doc *openapi) goType(schema *openapiSchema) string {
+	if schema == nil {
+		return "interface{}"
+	}
+	if schema.Ref != "" {
+		return exported(strings.TrimPrefix(schema.Ref, "#/components/schemas/"))
+	}
+	switch schema.Type {
+	case "string":
+		switch schema.Format {
+		case "date-time":
+			return "time.Time"
+		case "byte":
+			return "[]byte"
+		}
+		return "string"
+	case "integer":
+		switch schema.Format {
+		case "int32":
+			return "int32"
+		case "int64":
+			return "int64"
+		}
+		return "int"
+	case "number":
+		if schema.Format == "float" {
+			return "float32"
+		}
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "[]" + doc.goType(schema.Items)
+	case "object":
+		if props, ok := schema.AdditionalProperties.(map[string]interface{}); ok && len(props) > 0 {
+			b, err := yaml.Marshal(props)
+			if err == nil {
+				items := &openapiSchema{}
+				if yaml.Unmarshal(b, items) == nil {
+					return "map[string]" + doc.goType(items)
+				}
+			}
+		}
+		return "map[string]interface{}"
+	}
+	return "interface{}"
+}
+
+// parameter resolves a reference to a parameter of the components
+func (doc *openapi) parameter(param openapiParameter) (openapiParameter, error) {
+	if param.Ref == "" {
+		return param, nil
+	}
+	p, ok := doc.Components.Parameters[strings.TrimPrefix(param.Ref, "#/components/parameters/")]
+	if !ok {
+		return param, fmt.Errorf("unknown parameter '%s'", param.Ref)
+	}
+	return p, nil
+}
+
+// models returns the component schemas as Go types
+func (doc *openapi) models() []apiModel {
+	var models []apiModel
+	for name, schema := range doc.Components.Schemas {
+		m := apiModel{Name: exported(name), Doc: strings.Join(strings.Fields(schema.Description), " ")}
+		if len(schema.Properties) == 0 {
+			m.Type = doc.goType(schema)
+			models = append(models, m)
+			continue
+		}
+		required := make(map[string]bool)
+		for _, name := range schema.Required {
+			required[name] = true
+		}
+		for prop, s := range schema.Properties {
+			typ := doc.goType(s)
+			tag := prop
+			if !required[prop] {
+				tag += ",omitempty"
+				if s.Ref != "" || typ == "time.Time" {
+					typ = "*" + typ
+				}
+			}
+			m.Fields = append(m.Fields, apiField{Name: exported(prop), Type: typ, Tag: "`json:" + fmt.Sprintf("%q", tag) + "`"})
+		}
+		sort.Slice(m.Fields, func(i, j int) bool { return m.Fields[i].Name < m.Fields[j].Name })
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return models
+}
+
+var pathParams = regexp.MustCompile(`\{([^}]+)\}`)
+
+// reserved are the identifiers and packages used by the generated methods which
+// parameters may not shadow
+var reserved = map[string]bool{
+	"body": true, "ctx": true, "err": true, "query": true, "req": true, "s": true, "uri": true, "v": true,
+	"context": true, "fmt": true, "http": true, "json": true, "time": true, "url": true,
+}
+
+// operation returns the service method of the operation
+func (doc *openapi) operation(method, path string, item openapiPathItem, op *openapiOperation) (apiOperation, error) {
+	name := op.OperationID
+	if name == "" {
+		name = strings.ToLower(method) + " " + pathParams.ReplaceAllString(path, "by $1")
+	}
+	o := apiOperation{
+		Name:    exported(name),
+		Summary: strings.Join(strings.Fields(op.Summary), " "),
+		Verb:    method,
+		Method:  "http.Method" + strings.ToUpper(method[:1]) + strings.ToLower(method[1:]),
+		Path:    path,
+	}
+
+	params := make(map[string]openapiParameter)
+	for _, list := range [][]openapiParameter{item.Parameters, op.Parameters} {
+		for _, param := range list {
+			p, err := doc.parameter(param)
+			if err != nil {
+				return o, err
+			}
+			params[p.In+":"+p.Name] = p
+		}
+	}
+
+	o.Format = strings.ReplaceAll(path, "%", "%%")
+	for _, match := range pathParams.FindAllStringSubmatch(path, -1) {
+		p, ok := params["path:"+match[1]]
+		if !ok {
+			p = openapiParameter{Name: match[1], In: "path", Schema: &openapiSchema{Type: "string"}}
+		}
+		arg := unexported(p.Name)
+		if reserved[arg] {
+			arg += "Param"
+		}
+		typ := doc.goType(p.Schema)
+		o.Params = append(o.Params, apiField{Name: arg, Type: typ})
+		o.Format = strings.Replace(o.Format, match[0], "%s", 1)
+		if typ == "string" {
+			o.Args = append(o.Args, "url.PathEscape("+arg+")")
+		} else {
+			o.Args = append(o.Args, "url.PathEscape(fmt.Sprint("+arg+"))")
+		}
+	}
+	for _, p := range params {
+		if p.In == "query" {
+			o.Query = true
+		}
+	}
+
+	if schema := op.RequestBody.schema(); schema != nil {
+		o.Body = doc.goType(schema)
+		if schema.Ref != "" {
+			o.Body = "*" + o.Body
+		}
+	}
+
+	// the result is the json content of the first successful response
+	var codes []string
+	for code := range op.Responses {
+		if strings.HasPrefix(code, "2") {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		res := op.Responses[code]
+		if schema := res.schema(); schema != nil {
+			o.Result = doc.goType(schema)
+			o.Pointer = !strings.HasPrefix(o.Result, "[]") && !strings.HasPrefix(o.Result, "map[") && o.Result != "interface{}"
+			break
+		}
+	}
+	return o, nil
+}
+
+// api returns the view of the document for generation
+func (doc *openapi) api() (*api, error) {
+	a := &api{Models: doc.models()}
+	services := make(map[string]*apiService)
+	names := make(map[string]string)
+	for path, item := range doc.Paths {
+		for method, op := range item.operations() {
+			o, err := doc.operation(method, path, item, op)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, path, err)
+			}
+			service := "Default"
+			if len(op.Tags) > 0 {
+				service = exported(op.Tags[0])
+			}
+			if other, ok := names[service+"."+o.Name]; ok {
+				return nil, fmt.Errorf("%s %s: duplicate operation %s of %s", method, path, o.Name, other)
+			}
+			names[service+"."+o.Name] = method + " " + path
+			if services[service] == nil {
+				services[service] = &apiService{Name: service}
+			}
+			services[service].Operations = append(services[service].Operations, o)
+		}
+	}
+	for _, s := range services {
+		sort.Slice(s.Operations, func(i, j int) bool { return s.Operations[i].Name < s.Operations[j].Name })
+		a.Services = append(a.Services, *s)
+	}
+	sort.Slice(a.Services, func(i, j int) bool { return a.Services[i].Name < a.Services[j].Name })
+	if len(a.Services) == 0 && len(a.Models) == 0 {
+		return nil, errors.New("no operations or schemas")
+	}
+	return a, nil
+}
+
+const qopenapi = `// Code generated by "genwith {{.Flags}}"; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+{{range .API.Models}}
+// {{.Name}} is a model of the api
+{{- if .Doc}}
+//
+// {{.Doc}}
+{{- end}}
+{{- if .Fields}}
+type {{.Name}} struct {
+	{{- range .Fields}}
+	{{.Name}} {{.Type}} {{.Tag}}
+	{{- end}}
+}
+{{- else}}
+type {{.Name}} {{.Type}}
+{{- end}}
+{{end}}
+{{- if .API.Services}}
+// services are the api services of the Client, embed it in the Client declaration
+type services struct {
+{{- range .API.Services}}
+	{{.Name}} *{{.Name}}Service
+{{- end}}
+}
+
+// withServices creates the services of the client
+func withServices() Option {
+	return func(c *Client) error {
+		{{- range .API.Services}}
+		c.{{.Name}} = &{{.Name}}Service{service{client: c}}
+		{{- end}}
+		return nil
+	}
+}
+{{- end}}
+{{range .API.Services}}
+{{- $service := .Name}}
+// {{.Name}}Service is the {{.Name}} api service
+type {{.Name}}Service struct {
+	service
+}
+{{range .Operations}}
+// {{.Name}} calls {{.Verb}} {{.Path}}
+{{- if .Summary}}
+//
+// {{.Summary}}
+{{- end}}
+func (s *{{$service}}Service) {{.Name}}(ctx context.Context
+	{{- range .Params}}, {{.Name}} {{.Type}}{{end}}
+	{{- if .Query}}, query url.Values{{end}}
+	{{- if .Body}}, body {{.Body}}{{end}}) {{if .Result}}({{if .Pointer}}*{{end}}{{.Result}}, error){{else}}error{{end}} {
+	uri := {{if .Args}}fmt.Sprintf({{printf "%q" .Format}}{{range .Args}}, {{.}}{{end}}){{else}}{{printf "%q" .Path}}{{end}}
+	{{- if .Query}}
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	{{- end}}
+	{{- if .Body}}
+	req, err := s.client.newRequest(ctx, {{.Method}}, uri, body)
+	{{- else}}
+	req, err := s.client.newAPIRequest(ctx, {{.Method}}, uri)
+	{{- end}}
+	if err != nil {
+		return {{if .Result}}nil, {{end}}err
+	}
+	{{- if .Result}}
+	var v {{.Result}}
+	if err := s.client.do(req, &v); err != nil {
+		return nil, err
+	}
+	return {{if .Pointer}}&{{end}}v, nil
+	{{- else}}
+	return s.client.do(req, nil)
+	{{- end}}
+}
+{{end}}
+{{- end}}
+`
+
+// openapiCommand generates the services and models of an OpenAPI 3 document for the client
+func openapiCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "openapi",
+		Usage: "Generate services, models, and methods calling do from an OpenAPI 3 document",
+		Description: "The generated code requires a client generated with --client, --do, --base-url, and\n" +
+			"--encoder json, without --services, and the services struct embedded in the Client. With --name\n" +
+			"the client variant is generated first.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "spec",
+				Required: true,
+				Usage:    "The OpenAPI 3 document, in yaml or json",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			doc, err := readOpenAPI(c.String("spec"))
+			if err != nil {
+				return err
+			}
+			a, err := doc.api()
+			if err != nil {
+				return fmt.Errorf("%s: %w", c.String("spec"), err)
+			}
+			w := with{
+				Flags:   strings.Join(os.Args[1:], " "),
+				Package: c.String("package"),
+				Name:    c.String("name"),
+				API:     a,
+			}
+			prefix := w.Package
+			renames := hooks(w.Name)
+			if w.Name != "" {
+				prefix += "_" + strings.ToLower(w.Name)
+				// the services refer to the renamed declarations of the client variant
+				renames, err = declared(prefix+"_with.go", w.Name)
+				if err != nil {
+					return fmt.Errorf("reading the client variant: %w", err)
+				}
+			}
+			return write(c.Context, w, output{prefix + "_openapi.go", []string{qopenapi}}, renames)
+		},
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const spec = `openapi: 3.0.3
+paths:
+  /pets:
+    get:
+      operationId: listPets
+      tags: [pets]
+      parameters:
+        - name: limit
+          in: query
+          schema:
+            type: integer
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: "#/components/schemas/Pet"
+    post:
+      operationId: createPet
+      tags: [pets]
+      requestBody:
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/Pet"
+      responses:
+        "201":
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Pet"
+  /pets/{pet_id}:
+    parameters:
+      - $ref: "#/components/parameters/PetID"
+    get:
+      operationId: getPet
+      tags: [pets]
+      summary: Returns   the pet
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Pet"
+  /links/{url}:
+    delete:
+      responses:
+        "204":
+          description: deleted
+components:
+  parameters:
+    PetID:
+      name: pet_id
+      in: path
+      required: true
+      schema:
+        type: integer
+        format: int64
+  schemas:
+    Pet:
+      description: A pet of the store
+      required: [name]
+      properties:
+        name:
+          type: string
+        born:
+          type: string
+          format: date-time
+        owner:
+          $ref: "#/components/schemas/Owner"
+        tags:
+          type: object
+          additionalProperties:
+            type: string
+    Owner:
+      properties:
+        id:
+          type: string
+`
+
+// readSpec writes the spec to a file and reads it
+func readSpec(t *testing.T, src string) (*openapi, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "spec.yaml")
+	if err := os.WriteFile(file, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return readOpenAPI(file)
+}
+
+func TestIdentifiers(t *testing.T) {
+	tests := map[string]struct {
+		exported, unexported string
+	}{
+		"pet_id":          {"PetID", "petID"},
+		"petId":           {"PetID", "petID"},
+		"HTTPServer":      {"HTTPServer", "httpServer"},
+		"get /pets/by id": {"GetPetsByID", "getPetsByID"},
+		"type":            {"Type", "typeParam"},
+		"2fa":             {"X2fa", "x2fa"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if s := exported(name); s != tt.exported {
+				t.Errorf("exported %s, expected %s", s, tt.exported)
+			}
+			if s := unexported(name); s != tt.unexported {
+				t.Errorf("unexported %s, expected %s", s, tt.unexported)
+			}
+		})
+	}
+}
+
+func TestReadOpenAPI(t *testing.T) {
+	tests := map[string]struct {
+		spec string
+		err  bool
+	}{
+		"openapi 3":  {spec: spec},
+		"swagger 2":  {spec: "swagger: \"2.0\"\npaths: {}\n", err: true},
+		"no version": {spec: "paths: {}\n", err: true},
+		"not yaml":   {spec: "openapi: [3.0\n", err: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readSpec(t, tt.spec); (err != nil) != tt.err {
+				t.Errorf("error %v, expected an error %t", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAPI(t *testing.T) {
+	doc, err := readSpec(t, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := doc.api()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := make(map[string]apiModel)
+	for _, m := range a.Models {
+		models[m.Name] = m
+	}
+	fields := make(map[string]string)
+	for _, f := range models["Pet"].Fields {
+		fields[f.Name] = f.Type + " " + f.Tag
+	}
+	for name, field := range map[string]string{
+		"Name":  "string `json:\"name\"`",
+		"Born":  "*time.Time `json:\"born,omitempty\"`",
+		"Owner": "*Owner `json:\"owner,omitempty\"`",
+		"Tags":  "map[string]string `json:\"tags,omitempty\"`",
+	} {
+		if fields[name] != field {
+			t.Errorf("Pet.%s is %s, expected %s", name, fields[name], field)
+		}
+	}
+	if doc := models["Pet"].Doc; doc != "A pet of the store" {
+		t.Errorf("Pet doc %s", doc)
+	}
+
+	operations := make(map[string]apiOperation)
+	for _, s := range a.Services {
+		for _, o := range s.Operations {
+			operations[s.Name+"."+o.Name] = o
+		}
+	}
+	if len(operations) != 4 {
+		t.Errorf("found operations %v", operations)
+	}
+	tests := map[string]struct {
+		params, format, body, result string
+		query, pointer               bool
+	}{
+		// the path parameter is a reference to the components
+		"Pets.GetPet":    {params: "petID int64", format: "/pets/%s", result: "Pet", pointer: true},
+		"Pets.ListPets":  {result: "[]Pet", query: true},
+		"Pets.CreatePet": {body: "*Pet", result: "Pet", pointer: true},
+		// the parameter would shadow the url package
+		"Default.DeleteLinksByURL": {params: "urlParam string", format: "/links/%s"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			o, ok := operations[name]
+			if !ok {
+				t.Fatalf("no operation %s", name)
+			}
+			var params []string
+			for _, p := range o.Params {
+				params = append(params, p.Name+" "+p.Type)
+			}
+			if s := strings.Join(params, ", "); s != tt.params {
+				t.Errorf("params %s, expected %s", s, tt.params)
+			}
+			if tt.format != "" && o.Format != tt.format {
+				t.Errorf("format %s, expected %s", o.Format, tt.format)
+			}
+			if o.Body != tt.body {
+				t.Errorf("body %s, expected %s", o.Body, tt.body)
+			}
+			if o.Result != tt.result || o.Pointer != tt.pointer || o.Query != tt.query {
+				t.Errorf("result %s, pointer %t, query %t", o.Result, o.Pointer, o.Query)
+			}
+		})
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	tests := map[string]string{
+		"duplicate operation": `openapi: 3.0.0
+paths:
+  /a:
+    get:
+      operationId: fetch
+  /b:
+    get:
+      operationId: fetch
+`,
+		"unknown parameter": `openapi: 3.0.0
+paths:
+  /a/{id}:
+    get:
+      parameters:
+        - $ref: "#/components/parameters/ID"
+`,
+		"no operations": "openapi: 3.0.0\n",
+	}
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			doc, err := readSpec(t, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = doc.api(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGenerateOpenAPI(t *testing.T) {
+	doc, err := readSpec(t, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := doc.api()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "gw_openapi.go")
+	if err = generate(with{Package: "gw", API: a}, file, []string{qopenapi}, hooks("")); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parser.ParseFile(token.NewFileSet(), file, src, 0); err != nil {
+		t.Fatalf("parsing the generated code: %v", err)
+	}
+	for _, s := range []string{
+		"func (s *PetsService) GetPet(ctx context.Context, petID int64) (*Pet, error) {",
+		"func (s *PetsService) ListPets(ctx context.Context, query url.Values) ([]Pet, error) {",
+		"func (s *DefaultService) DeleteLinksByURL(ctx context.Context, urlParam string) error {",
+		"uri := fmt.Sprintf(\"/pets/%s\", url.PathEscape(fmt.Sprint(petID)))",
+		"func (s *PetsService) CreatePet(ctx context.Context, body *Pet) (*Pet, error) {",
+		"req, err := s.client.newRequest(ctx, http.MethodPost, uri, body)",
+		"c.Pets = &PetsService{service{client: c}}",
+		"// Returns the pet",
+	} {
+		if !strings.Contains(string(src), s) {
+			t.Errorf("generated code does not contain %s", s)
+		}
+	}
+}
+
+func TestGenerateOpenAPIVariant(t *testing.T) {
+	doc, err := readSpec(t, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := doc.api()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// the declarations of the client variant the services use
+	client := filepath.Join(dir, "gw_up_with.go")
+	if err = os.WriteFile(client, []byte("package gw\n\ntype upService struct {\n\tclient *UpClient\n}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	renames, err := declared(client, "Up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "gw_up_openapi.go")
+	if err = generate(with{Package: "gw", Name: "Up", API: a}, file, []string{qopenapi}, renames); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"func withUpServices() UpOption {",
+		"return func(c *UpClient) error {",
+		"c.Pets = &UpPetsService{upService{client: c}}",
+		"func (s *UpPetsService) GetPet(ctx context.Context, petID int64) (*UpPet, error) {",
+	} {
+		if !strings.Contains(string(src), s) {
+			t.Errorf("generated code does not contain %s", s)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	gofmt "go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// hooks are the identifiers provided by the package for the generated code
+// which differ between client variants
+func hooks(name string) map[string]string {
+	return map[string]string{
+		"Client":       name + "Client",
+		"Option":       name + "Option",
+		"withServices": "with" + name + "Services",
+	}
+}
+
+// variant returns the identifier renamed for the client variant
+func variant(name, ident string) string {
+	if !ast.IsExported(ident) {
+		return strings.ToLower(name[:1]) + name[1:] + string(unicode.ToUpper(rune(ident[0]))) + ident[1:]
+	}
+	for _, prefix := range []string{"With", "New", "Err", "Benchmark"} {
+		if strings.HasPrefix(ident, prefix) {
+			return prefix + name + strings.TrimPrefix(ident, prefix)
+		}
+	}
+	return name + ident
+}
+
+// original returns the identifier which is renamed to ident for the client variant
+func original(name, ident string) (string, bool) {
+	var candidates []string
+	if rest := strings.TrimPrefix(ident, strings.ToLower(name[:1])+name[1:]); rest != ident && rest != "" {
+		candidates = append(candidates, string(unicode.ToLower(rune(rest[0])))+rest[1:])
+	}
+	for _, prefix := range []string{"With", "New", "Err", "Benchmark"} {
+		if rest := strings.TrimPrefix(ident, prefix+name); rest != ident {
+			candidates = append(candidates, prefix+rest)
+		}
+	}
+	if rest := strings.TrimPrefix(ident, name); rest != ident && rest != "" {
+		candidates = append(candidates, rest)
+	}
+	for _, candidate := range candidates {
+		if token.IsIdentifier(candidate) && variant(name, candidate) == ident {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// declared returns the renames of the hooks and of the top-level identifiers declared
+// in the file generated for the client variant, for the files generated separately
+// which refer to them
+func declared(file, name string) (map[string]string, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), file, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	renames := hooks(name)
+	for ident := range f.Scope.Objects {
+		if orig, ok := original(name, ident); ok {
+			renames[orig] = ident
+		}
+	}
+	return renames, nil
+}
+
+// redoc renames the identifier if it begins the doc comment
+func redoc(doc *ast.CommentGroup, ident, renamed string) {
+	if doc == nil {
+		return
+	}
+	if text := doc.List[0].Text; strings.HasPrefix(text, "// "+ident+" ") {
+		doc.List[0].Text = "// " + renamed + strings.TrimPrefix(text, "// "+ident)
+	}
+}
+
+// rename the top-level identifiers declared in the source and the identifiers it
+// references from renames so more than one client variant can be generated in the
+// same package, the renamed declarations are added to renames for subsequent files
+func rename(src []byte, name string, renames map[string]string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	// objects declared at the top level of the file and their new names, the hooks keep
+	// their names when the generated code declares them
+	objects := make(map[*ast.Object]string)
+	for _, obj := range file.Scope.Objects {
+		if obj.Name != "_" {
+			renamed, ok := renames[obj.Name]
+			if !ok {
+				renamed = variant(name, obj.Name)
+			}
+			objects[obj] = renamed
+			renames[obj.Name] = renamed
+		}
+	}
+
+	// doc comments begin with the name of the declaration
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				redoc(decl.Doc, decl.Name.Name, objects[decl.Name.Obj])
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					redoc(decl.Doc, spec.Name.Name, objects[spec.Name.Obj])
+					redoc(spec.Doc, spec.Name.Name, objects[spec.Name.Obj])
+				case *ast.ValueSpec:
+					for _, ident := range spec.Names {
+						redoc(decl.Doc, ident.Name, objects[ident.Obj])
+						redoc(spec.Doc, ident.Name, objects[ident.Obj])
+					}
+				}
+			}
+		}
+	}
+
+	// the keys of struct literals may resolve to top-level objects of the same name
+	keys := make(map[*ast.Ident]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.CompositeLit); ok {
+			for _, elt := range lit.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					if ident, ok := kv.Key.(*ast.Ident); ok {
+						keys[ident] = true
+					}
+				}
+			}
+		}
+		return true
+	})
+	unresolved := make(map[*ast.Ident]bool)
+	for _, ident := range file.Unresolved {
+		unresolved[ident] = true
+	}
+
+	// an external test package refers to the declarations through the package name
+	pkg := strings.TrimSuffix(file.Name.Name, "_test")
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil && x.Name == pkg && renames[sel.Sel.Name] != "" {
+				sel.Sel.Name = renames[sel.Sel.Name]
+			}
+			return true
+		}
+		ident, ok := n.(*ast.Ident)
+		if !ok || keys[ident] {
+			return true
+		}
+		switch {
+		case ident.Obj != nil && objects[ident.Obj] != "":
+			ident.Name = objects[ident.Obj]
+		case unresolved[ident] && renames[ident.Name] != "":
+			ident.Name = renames[ident.Name]
+		}
+		return true
+	})
+
+	var buf bytes.Buffer
+	if err = gofmt.Node(&buf, fset, file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
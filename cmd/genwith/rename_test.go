@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestOriginal(t *testing.T) {
+	for _, ident := range []string{"service", "httpTransport", "Decoder", "WithRetry", "NewClient", "ErrNoContent",
+		"BenchmarkDoSmall", "Withdraw", "Newest", "Upload", "upload"} {
+		t.Run(ident, func(t *testing.T) {
+			renamed := variant("Up", ident)
+			orig, ok := original("Up", renamed)
+			if !ok || orig != ident {
+				t.Errorf("original of %s is %s, expected %s", renamed, orig, ident)
+			}
+		})
+	}
+	// identifiers which are not renamed for the variant
+	for _, ident := range []string{"Client", "service", "Dn", "WithDnRetry"} {
+		t.Run(ident, func(t *testing.T) {
+			if orig, ok := original("Up", ident); ok {
+				t.Errorf("original of %s is %s", ident, orig)
+			}
+		})
+	}
+}
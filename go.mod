@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/rs/zerolog v1.29.1
 	github.com/urfave/cli/v2 v2.25.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (